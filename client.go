@@ -12,9 +12,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"runtime"
 	"strings"
+	"time"
+
+	"github.com/danos/configd/rpc"
 )
 
 //GetFuncName() returns the unqualified name of the caller
@@ -37,6 +41,8 @@ type Client struct {
 	enc  *json.Encoder
 	dec  *json.Decoder
 	id   int
+	// set when the client re-dials a broken connection
+	redial *redialer
 }
 
 func Dial(network, address string) (*Client, error) {
@@ -45,27 +51,147 @@ func Dial(network, address string) (*Client, error) {
 		return nil, e
 	}
 
-	client := &Client{
+	return newClient(c), nil
+}
+
+func newClient(c net.Conn) *Client {
+	return &Client{
 		conn: c,
 		enc:  json.NewEncoder(c),
 		dec:  json.NewDecoder(c),
 		id:   0,
 	}
+}
 
-	return client, nil
+func (c *Client) Close() error {
+	return c.conn.Close()
 }
 
-func (c *Client) call(method string, args ...interface{}) (interface{}, error) {
+// ReconnectOptions configures a client that re-dials ifmgrd when its
+// connection breaks, so consumers can outlive a daemon restart.
+type ReconnectOptions struct {
+	// Re-dial attempts after a connection failure, 1 if zero.
+	Attempts int
+	// Wait before the first re-dial, doubling for each later one.
+	Backoff time.Duration
+	// Methods retried on the new connection, DefaultUntrustedMethods
+	// if nil. Other calls report the failure rather than risk
+	// repeating a change; the new connection serves later calls.
+	Idempotent []string
+}
+
+type redialer struct {
+	network, address string
+	attempts         int
+	backoff          time.Duration
+	idempotent       map[string]struct{}
+}
+
+// DialReconnecting connects to ifmgrd with a client that re-dials the
+// daemon when the connection breaks.
+func DialReconnecting(
+	network, address string,
+	opts ReconnectOptions,
+) (*Client, error) {
+	c, err := Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	r := &redialer{
+		network:    network,
+		address:    address,
+		attempts:   opts.Attempts,
+		backoff:    opts.Backoff,
+		idempotent: make(map[string]struct{}),
+	}
+	if r.attempts <= 0 {
+		r.attempts = 1
+	}
+	idempotent := opts.Idempotent
+	if idempotent == nil {
+		idempotent = DefaultUntrustedMethods
+	}
+	for _, method := range idempotent {
+		r.idempotent[method] = struct{}{}
+	}
+	c.redial = r
+	return c, nil
+}
+
+func (c *Client) reset(conn net.Conn) {
+	c.conn.Close()
+	c.conn = conn
+	c.enc = json.NewEncoder(conn)
+	c.dec = json.NewDecoder(conn)
+}
+
+// reconnect re-dials after the call failed with err, retrying the call
+// if it is idempotent.
+func (c *Client) reconnect(
+	method string,
+	args []interface{},
+	err error,
+) (*Response, error) {
+	r := c.redial
+	backoff := r.backoff
+	for attempt := 0; attempt < r.attempts; attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		conn, dialErr := net.Dial(r.network, r.address)
+		if dialErr != nil {
+			continue
+		}
+		c.reset(conn)
+		if _, ok := r.idempotent[method]; !ok {
+			return nil, err
+		}
+		var rep *Response
+		rep, err = c.roundTrip(method, args)
+		if err == nil {
+			return rep, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *Client) roundTrip(method string, args []interface{}) (*Response, error) {
 	var rep Response
 	c.id++
-	c.enc.Encode(&Request{Method: method, Args: args, Id: c.id})
-	c.dec.Decode(&rep)
+	//A transport failure must not be mistaken for an empty result
+	err := c.enc.Encode(&Request{Method: method, Args: args, Id: c.id})
+	if err != nil {
+		return nil, err
+	}
+	err = c.dec.Decode(&rep)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &rep, nil
+}
+
+func (c *Client) call(method string, args ...interface{}) (interface{}, error) {
+	rep, err := c.roundTrip(method, args)
+	if err != nil && c.redial != nil {
+		rep, err = c.reconnect(method, args, err)
+	}
+	if err != nil {
+		return nil, err
+	}
 	//fmt.Printf("%#v\n", &rpc.Request{Method: method, Args: args, Id: c.id})
 	//fmt.Printf("%#v\n", rep)
-	if err, ok := rep.Error.(string); ok {
+	switch err := rep.Error.(type) {
+	case nil:
+		return rep.Result, nil
+	case string:
 		return rep.Result, errors.New(err)
+	default:
+		// Not sent by ifmgrd, but don't lose an error that isn't
+		// a plain message
+		return rep.Result, fmt.Errorf("%s failed: %v", method, err)
 	}
-	return rep.Result, nil
 }
 
 //Per JSON RPC spec we must return a value upon success. This is not
@@ -83,6 +209,74 @@ func (c *Client) callBoolIgnore(method string, args ...interface{}) error {
 	}
 }
 
+func (c *Client) callBool(method string, args ...interface{}) (bool, error) {
+	i, err := c.call(method, args...)
+	if err != nil {
+		return false, err
+	}
+	b, ok := i.(bool)
+	if !ok {
+		return false, fmt.Errorf("Wrong return type for %s got %T expecting bool", method, i)
+	}
+	return b, nil
+}
+
+func (c *Client) callStrings(method string, args ...interface{}) ([]string, error) {
+	i, err := c.call(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	is, ok := i.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Wrong return type for %s got %T expecting []string", method, i)
+	}
+	out := make([]string, 0, len(is))
+	for _, v := range is {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Wrong return type for %s got %T expecting string element", method, v)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (c *Client) callStringMap(
+	method string,
+	args ...interface{},
+) (map[string]string, error) {
+	i, err := c.call(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	is, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Wrong return type for %s got %T expecting map[string]string", method, i)
+	}
+	out := make(map[string]string, len(is))
+	for k, v := range is {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Wrong return type for %s got %T expecting string value", method, v)
+		}
+		out[k] = s
+	}
+	return out, nil
+}
+
+func (c *Client) callInt(method string, args ...interface{}) (int, error) {
+	i, err := c.call(method, args...)
+	if err != nil {
+		return 0, err
+	}
+	// JSON numbers decode as float64
+	f, ok := i.(float64)
+	if !ok {
+		return 0, fmt.Errorf("Wrong return type for %s got %T expecting int", method, i)
+	}
+	return int(f), nil
+}
+
 func (c *Client) callString(method string, args ...interface{}) (string, error) {
 	s, err := c.call(method, args...)
 	if err != nil {
@@ -99,10 +293,54 @@ func (c *Client) Running(intf string) (string, error) {
 	return c.callString(GetFuncName(), intf)
 }
 
+func (c *Client) RunningEffective(intf string) (string, error) {
+	return c.callString(GetFuncName(), intf)
+}
+
+// RunningExists reports whether a path, such as
+// /interfaces/dataplane/dp0s3/mtu, exists in an interface's running
+// configuration.
+func (c *Client) RunningExists(intf, path string) (bool, error) {
+	return c.callBool(GetFuncName(), intf, path)
+}
+
 func (c *Client) Apply(config string) error {
 	return c.callBoolIgnore(GetFuncName(), config)
 }
 
+// ApplyWithTxn applies config identified by a transaction id, which is
+// echoed in the notifications for the interfaces it updates.
+func (c *Client) ApplyWithTxn(config, txnid string) error {
+	return c.callBoolIgnore(GetFuncName(), config, txnid)
+}
+
+// ApplyInterface applies only the named interface's configuration
+// from config.
+func (c *Client) ApplyInterface(intfName, config string) error {
+	return c.callBoolIgnore(GetFuncName(), intfName, config)
+}
+
+// ApplyCAS applies only the named interface's configuration from
+// config, and only if its apply generation is still generation. It
+// returns false if another update changed the interface first.
+func (c *Client) ApplyCAS(
+	intfName string,
+	generation int,
+	config string,
+) (bool, error) {
+	return c.callBool(GetFuncName(), intfName, generation, config)
+}
+
+// ApplyGeneration returns the interface's apply generation, which
+// increases each time its configuration changes.
+func (c *Client) ApplyGeneration(intfName string) (int, error) {
+	return c.callInt(GetFuncName(), intfName)
+}
+
+func (c *Client) SyncFromConfigd() error {
+	return c.callBoolIgnore(GetFuncName())
+}
+
 func (c *Client) Register(intfName string) error {
 	return c.callBoolIgnore(GetFuncName(), intfName)
 }
@@ -111,6 +349,16 @@ func (c *Client) Unregister(intfName string) error {
 	return c.callBoolIgnore(GetFuncName(), intfName)
 }
 
+func (c *Client) Decommission(intfName string) error {
+	return c.callBoolIgnore(GetFuncName(), intfName)
+}
+
+// ResetInterface removes the configuration applied to an interface
+// without it ceasing to be managed.
+func (c *Client) ResetInterface(intfName string) error {
+	return c.callBoolIgnore(GetFuncName(), intfName)
+}
+
 func (c *Client) Plug(intfName string) error {
 	return c.callBoolIgnore(GetFuncName(), intfName)
 }
@@ -118,3 +366,158 @@ func (c *Client) Plug(intfName string) error {
 func (c *Client) Unplug(intfName string) error {
 	return c.callBoolIgnore(GetFuncName(), intfName)
 }
+
+// PlugWithReason sends a plug event giving its reason or source, such
+// as udev, which is logged and included in the interface-state
+// notification.
+func (c *Client) PlugWithReason(intfName, reason string) error {
+	return c.callBoolIgnore(GetFuncName(), intfName, reason)
+}
+
+// UnplugWithReason sends an unplug event giving its reason or source.
+func (c *Client) UnplugWithReason(intfName, reason string) error {
+	return c.callBoolIgnore(GetFuncName(), intfName, reason)
+}
+
+func (c *Client) ClearError(intfName string, reapply bool) error {
+	return c.callBoolIgnore(GetFuncName(), intfName, reapply)
+}
+
+func (c *Client) Reconcile(intfName string) error {
+	return c.callBoolIgnore(GetFuncName(), intfName)
+}
+
+// DumpConfig writes each managed interface's running configuration to
+// the daemon's dump directory, returning the files written.
+func (c *Client) DumpConfig() ([]string, error) {
+	return c.callStrings(GetFuncName())
+}
+
+func (c *Client) MaxApplyLag() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) Stats() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) ListCommits() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+// ListSessions returns the open sessions, mapped to the interface whose
+// commit each was created for.
+func (c *Client) ListSessions() (map[string]string, error) {
+	return c.callStringMap(GetFuncName())
+}
+
+func (c *Client) Transitions() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) StateGraph() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) OperationalState(intfName string) (string, error) {
+	return c.callString(GetFuncName(), intfName)
+}
+
+func (c *Client) QueueDepths() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) AllConverged() (bool, error) {
+	return c.callBool(GetFuncName())
+}
+
+func (c *Client) PendingInterfaces() ([]string, error) {
+	return c.callStrings(GetFuncName())
+}
+
+// Applying returns the managed interfaces whose commit actions are
+// running.
+func (c *Client) Applying() ([]string, error) {
+	return c.callStrings(GetFuncName())
+}
+
+func (c *Client) TimeInState(intfName string) (string, error) {
+	return c.callString(GetFuncName(), intfName)
+}
+
+// LastOutput returns the output of the commit actions of an
+// interface's most recent successful commit.
+func (c *Client) LastOutput(intfName string) (string, error) {
+	return c.callString(GetFuncName(), intfName)
+}
+
+// LatencyStats returns JSON percentiles of how long an interface's
+// recent commits took.
+func (c *Client) LatencyStats(intfName string) (string, error) {
+	return c.callString(GetFuncName(), intfName)
+}
+
+// InterfaceCounters returns JSON counts of an interface's applies,
+// resets, plug and unplug events and failed commits.
+func (c *Client) InterfaceCounters(intfName string) (string, error) {
+	return c.callString(GetFuncName(), intfName)
+}
+
+// InterfaceState returns the state of an interface's state machine,
+// such as Plugged or Applying.
+func (c *Client) InterfaceState(intfName string) (string, error) {
+	return c.callString(GetFuncName(), intfName)
+}
+
+// InterfaceStates returns the state of each named interface, or of
+// every managed interface if none are named.
+func (c *Client) InterfaceStates(names ...string) (map[string]string, error) {
+	if names == nil {
+		names = []string{}
+	}
+	return c.callStringMap(GetFuncName(), names)
+}
+
+func (c *Client) CommitActions(intfName string) (string, error) {
+	return c.callString(GetFuncName(), intfName)
+}
+
+// DiffJSON returns the changes committing an interface's candidate
+// configuration would make as a JSON tree.
+func (c *Client) DiffJSON(intfName string) (string, error) {
+	return c.callString(GetFuncName(), intfName)
+}
+
+// CandidateRunning returns an interface's candidate and running
+// configuration, taken together so they are consistent.
+func (c *Client) CandidateRunning(intfName string) (string, string, error) {
+	trees, err := c.callStringMap(GetFuncName(), intfName)
+	if err != nil {
+		return "", "", err
+	}
+	return trees["candidate"], trees["running"], nil
+}
+
+func (c *Client) DaemonConfig() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) ManagerConfig() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) Metrics() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) ListManaged() ([]string, error) {
+	return c.callStrings(GetFuncName())
+}
+
+func (c *Client) TypeSummary() (string, error) {
+	return c.callString(GetFuncName())
+}
+
+func (c *Client) ConfigdTreeGet(db rpc.DB, path, encoding string) (string, error) {
+	return c.callString(GetFuncName(), db, path, encoding)
+}
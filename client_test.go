@@ -0,0 +1,169 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Connection closed by the server before it sends a response
+func TestClientCallClosedBeforeResponse(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go func() {
+		var req Request
+		json.NewDecoder(srv).Decode(&req)
+		srv.Close()
+	}()
+
+	c := newClient(cli)
+	_, err := c.Running("dp0s3")
+	if err == nil {
+		t.Fatal("Expected error from closed connection, got success")
+	}
+}
+
+// Connection closed by the server midway through the response
+func TestClientCallShortRead(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go func() {
+		var req Request
+		json.NewDecoder(srv).Decode(&req)
+		srv.Write([]byte(`{"result":"{\"interfaces\"`))
+		srv.Close()
+	}()
+
+	c := newClient(cli)
+	out, err := c.Running("dp0s3")
+	if err == nil {
+		t.Fatalf("Expected error from short read, got result %q", out)
+	}
+}
+
+// Connection closed before the request could be written
+func TestClientCallClosedBeforeRequest(t *testing.T) {
+	cli, srv := net.Pipe()
+	srv.Close()
+
+	c := newClient(cli)
+	err := c.Register("dp0s3")
+	if err == nil {
+		t.Fatal("Expected error writing to closed connection, got success")
+	}
+}
+
+// Serve a single request with the dispatcher, as the server would
+func testServeOne(t *testing.T, srv net.Conn) {
+	defer srv.Close()
+	var req Request
+	if err := json.NewDecoder(srv).Decode(&req); err != nil {
+		t.Errorf("Failed to decode request: %s", err)
+		return
+	}
+	config, _ := req.Args[0].(string)
+	result, err := (&Disp{}).Apply(config)
+	json.NewEncoder(srv).Encode(newResponse(result, err, req.Id))
+}
+
+func TestClientApplyInvalidJSON(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go testServeOne(t, srv)
+
+	c := newClient(cli)
+	err := c.Apply(`{"interfaces": {`)
+	if err == nil {
+		t.Fatal("Expected error applying invalid JSON, got success")
+	}
+	if !strings.Contains(err.Error(), "not valid JSON") {
+		t.Fatalf("Expected JSON syntax error, got: %s", err)
+	}
+}
+
+// A structured error must not be reported as a wrong return type
+func TestClientCallStructuredError(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go func() {
+		var req Request
+		json.NewDecoder(srv).Decode(&req)
+		srv.Write([]byte(`{"error":{"message":"bad config"},"id":1}`))
+		srv.Close()
+	}()
+
+	c := newClient(cli)
+	err := c.Apply("{}")
+	if err == nil || !strings.Contains(err.Error(), "bad config") {
+		t.Fatalf("Expected structured error to be reported, got: %v", err)
+	}
+}
+
+// Listen on a unix socket, dropping the first connection after it
+// sends a request, as if the daemon restarted, and answering requests
+// on later connections with result.
+func testRestartingServer(t *testing.T, result interface{}) string {
+	sock := filepath.Join(t.TempDir(), "ifmgrd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, restart bool) {
+				defer conn.Close()
+				dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+				for {
+					var req Request
+					if dec.Decode(&req) != nil || restart {
+						return
+					}
+					enc.Encode(newResponse(result, nil, req.Id))
+				}
+			}(conn, n == 0)
+		}
+	}()
+	return sock
+}
+
+func TestReconnectRetriesIdempotentCall(t *testing.T) {
+	sock := testRestartingServer(t, "{}")
+	c, err := DialReconnecting("unix", sock, ReconnectOptions{})
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer c.Close()
+
+	out, err := c.Running("dp0s3")
+	if err != nil || out != "{}" {
+		t.Fatalf("Expected retried call to succeed, got %q, %v", out, err)
+	}
+}
+
+func TestReconnectDoesNotRetryMutation(t *testing.T) {
+	sock := testRestartingServer(t, true)
+	c, err := DialReconnecting("unix", sock, ReconnectOptions{})
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer c.Close()
+
+	if err := c.Register("dp0s3"); err == nil {
+		t.Fatal("Expected interrupted Register to fail, got success")
+	}
+	if err := c.Register("dp0s3"); err != nil {
+		t.Fatalf("Expected call on new connection to succeed, got %s", err)
+	}
+}
@@ -27,7 +27,7 @@ type action struct {
 var actions = map[string]*action{
 	"apply": &action{
 		"apply",
-		"apply latest config to managed interfaces",
+		"apply latest config to managed interfaces, or only to device if given",
 		apply,
 		0,
 	},
@@ -43,15 +43,75 @@ var actions = map[string]*action{
 		unregister,
 		1,
 	},
+	"graph": &action{
+		"graph",
+		"print the interface state-machine as a Graphviz DOT graph",
+		graph,
+		0,
+	},
+	"output": &action{
+		"output",
+		"print output of device's last successful commit actions",
+		output,
+		0,
+	},
 	"plug": &action{
 		"plug",
-		"send plug event for device",
+		"send plug event for device, with the reason if one follows",
 		plug,
 		0,
 	},
+	"clear-error": &action{
+		"clear-error",
+		"clear device's last commit error, re-applying if 'reapply' follows",
+		clearError,
+		1,
+	},
+	"config": &action{
+		"config",
+		"print the configuration ifmgrd is running with as JSON",
+		daemonConfig,
+		0,
+	},
+	"decommission": &action{
+		"decommission",
+		"remove device's config and stop managing it until registered",
+		decommission,
+		1,
+	},
+	"dump": &action{
+		"dump",
+		"write running config of managed interfaces to the dump directory",
+		dump,
+		0,
+	},
+	"reset": &action{
+		"reset",
+		"remove device's config but keep managing it",
+		reset,
+		1,
+	},
+	"state": &action{
+		"state",
+		"print operational state of device as RFC7951 JSON",
+		state,
+		0,
+	},
+	"status": &action{
+		"status",
+		"print the state of managed devices",
+		status,
+		0,
+	},
+	"sync": &action{
+		"sync",
+		"make ifmgrd fetch and apply configd's running config",
+		sync,
+		0,
+	},
 	"unplug": &action{
 		"unplug",
-		"send unplug event for device",
+		"send unplug event for device, with the reason if one follows",
 		unplug,
 		0,
 	},
@@ -70,10 +130,17 @@ func apply(client *ifmgrd.Client, args ...string) error {
 	if err != nil {
 		return err
 	}
+	if len(args) > 0 {
+		return client.ApplyInterface(args[0], cfg)
+	}
 	err = client.Apply(cfg)
 	return err
 }
 
+func sync(client *ifmgrd.Client, args ...string) error {
+	return client.SyncFromConfigd()
+}
+
 func register(client *ifmgrd.Client, args ...string) error {
 	return client.Register(args[0])
 }
@@ -82,6 +149,43 @@ func unregister(client *ifmgrd.Client, args ...string) error {
 	return client.Unregister(args[0])
 }
 
+func decommission(client *ifmgrd.Client, args ...string) error {
+	return client.Decommission(args[0])
+}
+
+func reset(client *ifmgrd.Client, args ...string) error {
+	return client.ResetInterface(args[0])
+}
+
+func dump(client *ifmgrd.Client, args ...string) error {
+	files, err := client.DumpConfig()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fmt.Println(file)
+	}
+	return nil
+}
+
+func daemonConfig(client *ifmgrd.Client, args ...string) error {
+	out, err := client.DaemonConfig()
+	if err != nil {
+		return err
+	}
+	fmt.Println(out)
+	return nil
+}
+
+func graph(client *ifmgrd.Client, args ...string) error {
+	out, err := client.StateGraph()
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
+
 func getIntfName(args ...string) (string, error) {
 	var ifname string
 	if len(args) == 0 {
@@ -100,6 +204,9 @@ func plug(client *ifmgrd.Client, args ...string) error {
 	if err != nil {
 		return err
 	}
+	if len(args) > 1 {
+		return client.PlugWithReason(ifname, args[1])
+	}
 	return client.Plug(ifname)
 }
 
@@ -108,9 +215,69 @@ func unplug(client *ifmgrd.Client, args ...string) error {
 	if err != nil {
 		return err
 	}
+	if len(args) > 1 {
+		return client.UnplugWithReason(ifname, args[1])
+	}
 	return client.Unplug(ifname)
 }
 
+func clearError(client *ifmgrd.Client, args ...string) error {
+	var reapply bool
+	if len(args) > 1 {
+		if args[1] != "reapply" {
+			return fmt.Errorf("unexpected argument %s", args[1])
+		}
+		reapply = true
+	}
+	return client.ClearError(args[0], reapply)
+}
+
+func output(client *ifmgrd.Client, args ...string) error {
+	ifname, err := getIntfName(args...)
+	if err != nil {
+		return err
+	}
+	out, err := client.LastOutput(ifname)
+	if err != nil {
+		return err
+	}
+	if out != "" {
+		fmt.Println(out)
+	}
+	return nil
+}
+
+func state(client *ifmgrd.Client, args ...string) error {
+	ifname, err := getIntfName(args...)
+	if err != nil {
+		return err
+	}
+	out, err := client.OperationalState(ifname)
+	if err != nil {
+		return err
+	}
+	fmt.Println(out)
+	return nil
+}
+
+func status(client *ifmgrd.Client, args ...string) error {
+	states, err := client.InterfaceStates(args...)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Interface\tState")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, states[name])
+	}
+	return w.Flush()
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s <action> <args>\n", os.Args[0])
 	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, '\t', 0)
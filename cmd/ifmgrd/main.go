@@ -17,18 +17,160 @@ Usage:
         will write the profile information to the defined file.
 
 	-socketfile=<filename> When defined configd will write its pid to
-		the defined file (defualt: /run/ifmgrd/main.sock).
+		the defined file (defualt: /run/ifmgrd/main.sock). The daemon
+		holds a lock on <socketfile>.lock so a second daemon for the
+		same socket exits rather than taking it over.
 
 	-yangdir=<dir> Directory configd will load YANG files and watch
 		for updates (default: /usr/share/configd/yang).
 
+	-fallback-yangdir=<dir> Directory to load YANG files from when
+		those in yangdir fail to compile or define no interfaces,
+		as when yangdir is misconfigured. The daemon exits if
+		neither gives a usable schema (default: none).
+
     -configdsocket=<filename> Specify the location of the configd socket
         with which we can proxy requests (default: /run/configd/main.sock).
 
+	-apply-lag-threshold=<duration> Interfaces whose configuration has
+		been waiting to be applied for longer than this are reported
+		as stalled by MaxApplyLag (default: 1m, 0 disables).
+
+	-max-interfaces=<n> Reject registration of interfaces beyond this
+		many (default: 0, unlimited).
+
+	-max-sessions=<n> Refuse to open client configuration sessions
+		beyond this many, protecting the daemon from session
+		exhaustion. ifmgrd's own commit sessions are not limited
+		(default: 0, unlimited).
+
+	-max-commit-output=<bytes> Keep at most this much of the output
+		of each commit's actions, truncating the rest with a marker,
+		so a script flooding its output cannot exhaust the daemon's
+		memory (default: 65536, 0 is unlimited).
+
+	-apply-timeout=<duration> If an interface's commit has not completed
+		after this long it is abandoned, an apply-timeout
+		notification is emitted and the interface's state machine
+		recovers (default: 10m, 0 disables).
+
+	-apply-debounce=<duration> Coalesce Apply calls that arrive within
+		this long of the first, applying only the last configuration.
+		Useful at boot when configuration loads in stages
+		(default: 0, apply immediately).
+
+	-min-commit-interval=<duration> Configuration received while an
+		interface's commit is running is committed no sooner than
+		this after that commit started, coalescing changes received
+		in between. Protects the dataplane from a flapping
+		configuration source (default: 0, disabled).
+
+	-auto-register Start managing every interface present in applied
+		configuration instead of only registered interfaces
+		(default: false).
+
+	-show-secrets Show configuration secrets to every caller rather than
+		only members of the secrets group, and skip looking up the
+		caller's groups when -trusted-groups is not set. Anyone able
+		to connect to the socket can then read passwords and keys;
+		only use on trusted single-user lab systems (default: false).
+
+	-eventsocket=<filename> Listen on this socket and stream state
+		transitions, commit results and notifications to every
+		client as newline delimited JSON. A lighter-weight local
+		alternative to VCI (default: none).
+
+	-strict-apply Reject an Apply whose interfaces configuration contains
+		nodes unknown to the schema, reporting the path of the
+		first one. Otherwise such nodes, usually the result of
+		configd running newer YANG or capabilities than ifmgrd, are
+		logged as a schema mismatch and not applied (default: false).
+
+	-notify-rate=<n> Emit at most this many notifications per second,
+		to protect subscribers from the burst when many interfaces
+		converge at boot (default: 0, unlimited).
+
+	-notify-burst=<n> Notifications that may be emitted together before
+		-notify-rate applies (default: 1).
+
+	-notify-batch While -notify-rate is holding notifications back,
+		combine waiting configuration-updated and interface-state
+		notifications into a single batch-update (default: false).
+
+	-require-configd Exit with an error rather than start serving if the
+		configd socket cannot be dialed, instead of coming up with
+		every proxied RPC failing (default: false).
+
+	-configd-wait=<duration> How long -require-configd keeps trying to
+		dial configd before giving up (default: 30s).
+
+	-registration-file=<filename> Record the registered interfaces in
+		this file and register them again when the daemon restarts,
+		so boot scripts need not re-register them (default: none,
+		registrations are lost on restart).
+
+	-dumpdir=<dir> Directory the DumpConfig RPC writes managed
+		interfaces' running configuration to, one timestamped file
+		per interface (default: /var/lib/ifmgrd/dump).
+
+	-redact-paths=<path,...> Configuration paths whose values are always
+		hidden in logged configuration differences and commit action
+		previews, even from members of the secrets group. Secret
+		nodes are always hidden in logs. Path elements may be *
+		to match any list key (default: none).
+
+	-manage-allowlist=<pattern,...> Only manage interfaces matching one
+		of these glob patterns, such as dp0*, refusing to register
+		others and leaving them out of -auto-register. For
+		introducing ifmgrd one interface at a time
+		(default: none, any interface is managed).
+
+	-plug-poll-interval=<duration> Check this often whether each managed
+		interface exists, plugging or unplugging it to match. A safety
+		net where nothing sends plug and unplug events
+		(default: 0, disabled).
+
+	-never-plugged-timeout=<duration> Report an interface that has not
+		been plugged this long after it was registered as waiting for
+		hardware, with a waiting-for-hardware notification, telling a
+		missing NIC apart from a configuration problem
+		(default: 0, disabled).
+
+	-observe Follow configuration and interface events without touching
+		the dataplane: commit actions are logged rather than run, while
+		running configuration and notifications report what would have
+		been applied. For shadow deployments and testing
+		(default: false).
+
+	-conn-concurrency=<n> Handle up to this many requests from one
+		connection at once, so a client may pipeline independent
+		calls. Responses may then be sent out of order and are
+		matched to requests by their id (default: 1, in turn).
+
+	-accept-backoff=<duration> Wait this long after a temporary error
+		accepting a connection, such as running out of file
+		descriptors, doubling the wait with each consecutive error
+		(default: 10ms).
+
+	-accept-backoff-max=<duration> Longest wait after consecutive
+		accept errors (default: 1s).
+
+	-trusted-groups=<group,...> Only root and members of these groups
+		may call methods that change state; other callers are
+		limited to the read-only methods (default: everyone trusted).
+
+	-no-mount-juggle Do not bind mount the configd socket into a private
+		location; use configdsocket directly. Intended for testing and
+		containers where the daemon lacks mount privileges.
+
 	SIGUSR1 Issuing SIGUSR1 to the daemon will toggle run-time
 		profiling. Profile data will be written to the file specified
 		by the cpuprofile option.
 
+	SIGINT, SIGTERM The daemon stops accepting connections, waits for
+		commits already started to complete, removes the mounts made
+		to take over configd's socket and exits.
+
 */
 package main
 
@@ -39,9 +181,13 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime/pprof"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/coreos/go-systemd/activation"
 	"github.com/danos/config/schema"
@@ -58,8 +204,37 @@ var cpuproffile os.File
 var cpuprofile string
 var socket string
 var yangdir string
+var fallbackyangdir string
 var capabilities string
 var configdsocket string
+var nomountjuggle bool
+var applylagthreshold time.Duration
+var maxinterfaces int
+var maxsessions int
+var maxcommitoutput int
+var applytimeout time.Duration
+var applydebounce time.Duration
+var mincommitinterval time.Duration
+var autoregister bool
+var showsecrets bool
+var eventsocket string
+var strictapply bool
+var notifyrate float64
+var notifyburst int
+var notifybatch bool
+var requireconfigd bool
+var registrationfile string
+var dumpdir string
+var redactpaths string
+var manageallowlist string
+var plugpollinterval time.Duration
+var observe bool
+var neverpluggedtimeout time.Duration
+var connconcurrency int
+var acceptbackoff time.Duration
+var acceptbackoffmax time.Duration
+var configdwait time.Duration
+var trustedgroups string
 
 func sigstartprof() {
 	sigch := make(chan os.Signal)
@@ -69,9 +244,7 @@ func sigstartprof() {
 		if cpuprofile != "" {
 			if !runningprof {
 				cpuproffile, err := os.Create(cpuprofile)
-				if err != nil {
-					log.Fatal(err)
-				}
+				fatal(err)
 				pprof.StartCPUProfile(cpuproffile)
 				runningprof = true
 			} else {
@@ -83,8 +256,24 @@ func sigstartprof() {
 	}
 }
 
+func splitList(list string) []string {
+	out := make([]string, 0)
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// fatal exits if err is set, first undoing any mounts jugglemounts
+// made so that configd's socket is not left hidden behind ifmgrd's.
 func fatal(err error) {
 	if err != nil {
+		if uerr := undomounts(); uerr != nil {
+			log.Println(uerr)
+		}
 		log.Fatal(err)
 	}
 }
@@ -102,6 +291,9 @@ func init() {
 		"/usr/share/configd/yang",
 		"Load YANG from specified directory.")
 
+	flag.StringVar(&fallbackyangdir, "fallback-yangdir", "",
+		"Load YANG from this directory if -yangdir gives no usable schema.")
+
 	flag.StringVar(&capabilities, "capabilities",
 		compile.DefaultCapsLocation,
 		"File specifying system capabilities")
@@ -110,6 +302,91 @@ func init() {
 		"/run/configd/main.sock",
 		"Location where the configd socket resides")
 
+	flag.BoolVar(&nomountjuggle, "no-mount-juggle", false,
+		"Use configdsocket directly instead of bind mounting it (testing/containers).")
+
+	flag.DurationVar(&applylagthreshold, "apply-lag-threshold",
+		time.Minute,
+		"Report interfaces waiting longer than this to apply config as stalled (0 disables).")
+
+	flag.IntVar(&maxinterfaces, "max-interfaces", 0,
+		"Maximum number of interfaces that may be registered (0 is unlimited).")
+
+	flag.IntVar(&maxsessions, "max-sessions", 0,
+		"Maximum number of sessions that may be open at once (0 is unlimited).")
+
+	flag.IntVar(&maxcommitoutput, "max-commit-output", 64*1024,
+		"Bytes of each commit's output to keep (0 is unlimited).")
+
+	flag.DurationVar(&applytimeout, "apply-timeout", 10*time.Minute,
+		"Abandon an interface commit that takes longer than this (0 disables).")
+
+	flag.DurationVar(&applydebounce, "apply-debounce", 0,
+		"Coalesce Apply calls arriving within this window (0 applies immediately).")
+
+	flag.DurationVar(&mincommitinterval, "min-commit-interval", 0,
+		"Minimum time between the starts of commits for an interface (0 disables).")
+
+	flag.BoolVar(&autoregister, "auto-register", false,
+		"Manage every interface present in the applied configuration.")
+
+	flag.BoolVar(&showsecrets, "show-secrets", false,
+		"Show secrets to every caller. INSECURE: see the package documentation.")
+
+	flag.StringVar(&eventsocket, "eventsocket", "",
+		"Path of a socket streaming state machine events as JSON lines.")
+
+	flag.BoolVar(&strictapply, "strict-apply", false,
+		"Reject applied interfaces config containing nodes unknown to the schema.")
+
+	flag.Float64Var(&notifyrate, "notify-rate", 0,
+		"Maximum notifications emitted per second (0 is unlimited).")
+
+	flag.IntVar(&notifyburst, "notify-burst", 1,
+		"Notifications that may be emitted at once under -notify-rate.")
+
+	flag.BoolVar(&notifybatch, "notify-batch", false,
+		"Batch notifications waiting under -notify-rate into batch-update.")
+
+	flag.BoolVar(&requireconfigd, "require-configd", false,
+		"Exit if the configd socket cannot be dialed within -configd-wait.")
+
+	flag.DurationVar(&configdwait, "configd-wait", 30*time.Second,
+		"How long -require-configd waits for configd.")
+
+	flag.StringVar(&registrationfile, "registration-file", "",
+		"Record registered interfaces here and register them again on restart.")
+
+	flag.StringVar(&dumpdir, "dumpdir", "/var/lib/ifmgrd/dump",
+		"Directory the dump RPC writes running configuration to.")
+
+	flag.StringVar(&redactpaths, "redact-paths", "",
+		"Comma separated configuration paths whose values are never logged.")
+
+	flag.StringVar(&manageallowlist, "manage-allowlist", "",
+		"Comma separated glob patterns of the interfaces that may be managed.")
+
+	flag.DurationVar(&plugpollinterval, "plug-poll-interval", 0,
+		"Plug or unplug managed interfaces to match the system this often (0 disables).")
+
+	flag.DurationVar(&neverpluggedtimeout, "never-plugged-timeout", 0,
+		"Report interfaces not plugged this long after registration (0 disables).")
+
+	flag.BoolVar(&observe, "observe", false,
+		"Log commit actions instead of running them (dry run).")
+
+	flag.IntVar(&connconcurrency, "conn-concurrency", 1,
+		"Requests from one connection handled at once.")
+
+	flag.DurationVar(&acceptbackoff, "accept-backoff", 10*time.Millisecond,
+		"Wait after a temporary accept error, doubling on each one.")
+
+	flag.DurationVar(&acceptbackoffmax, "accept-backoff-max", time.Second,
+		"Longest wait after consecutive accept errors.")
+
+	flag.StringVar(&trustedgroups, "trusted-groups", "",
+		"Comma separated groups allowed to call any method (empty trusts everyone).")
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
@@ -120,64 +397,226 @@ func init() {
 const tmppath = "/tmp/configd.org"
 const newconfigdsocket = tmppath + "/main.sock"
 
+// jugglemounts bind mounts configd's socket where ifmgrd can still
+// reach it, then mounts basepath over configd's socket directory so
+// that ifmgrd's socket takes its place.
 func jugglemounts() error {
+	fi, err := os.Stat(configdsocket)
+	if err != nil {
+		return fmt.Errorf("configd socket missing: %s", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("configd socket missing: %s is not a socket",
+			configdsocket)
+	}
+
 	//mkdir -p tmppath
-	err := os.MkdirAll(tmppath, 0755)
+	err = os.MkdirAll(tmppath, 0755)
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't create %s: %s", tmppath, err)
+	}
+
+	// a crashed run may have left something other than the
+	// mount point behind, which can't be bind mounted over
+	fi, err = os.Lstat(newconfigdsocket)
+	if err == nil && !fi.Mode().IsRegular() {
+		err = os.RemoveAll(newconfigdsocket)
+		if err != nil {
+			return fmt.Errorf("couldn't remove stale %s: %s",
+				newconfigdsocket, err)
+		}
 	}
 
 	//touch newsocket
 	f, err := os.Create(newconfigdsocket)
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't create %s: %s", newconfigdsocket, err)
 	}
 	f.Close()
 
 	//mkdir -p basepath
 	err = os.MkdirAll(basepath, 0755)
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't create %s: %s", basepath, err)
 	}
 
 	//mount --bind configdsocket newsocket
 	err = syscall.Mount(configdsocket,
 		newconfigdsocket, "", syscall.MS_BIND, "")
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't bind-mount %s on %s: %s",
+			configdsocket, newconfigdsocket, err)
 	}
 
 	//mount --bind basepath $(dirname configdsocket)
 	err = syscall.Mount(basepath,
 		filepath.Dir(configdsocket), "", syscall.MS_BIND, "")
 	if err != nil {
-		return err
+		syscall.Unmount(newconfigdsocket, 0)
+		return fmt.Errorf("couldn't bind-mount %s on %s: %s",
+			basepath, filepath.Dir(configdsocket), err)
 	}
 
+	atomic.StoreInt32(&juggled, 1)
 	return nil
 }
 
-func main() {
-	var err error
+// juggled is set while the mounts made by jugglemounts are in place.
+var juggled int32
 
-	flag.Parse()
+// undomounts undoes the mounts made by jugglemounts, if they are in
+// place and have not already been undone.
+func undomounts() error {
+	if !atomic.CompareAndSwapInt32(&juggled, 1, 0) {
+		return nil
+	}
+	return unjugglemounts()
+}
 
-	fatal(jugglemounts())
+// unjugglemounts undoes the mounts made by jugglemounts, returning
+// configd's socket to its directory.
+func unjugglemounts() error {
+	dir := filepath.Dir(configdsocket)
+	if err := syscall.Unmount(dir, 0); err != nil {
+		return fmt.Errorf("couldn't unmount %s: %s", dir, err)
+	}
+	if err := syscall.Unmount(newconfigdsocket, 0); err != nil {
+		return fmt.Errorf("couldn't unmount %s: %s", newconfigdsocket, err)
+	}
+	return nil
+}
 
-	go sigstartprof()
+// shutdownOnSignal shuts srv down on the first signal received on sigch,
+// closing stopped once commits in progress have completed.
+func shutdownOnSignal(
+	srv *ifmgrd.Srv,
+	sigch <-chan os.Signal,
+	stopped chan<- struct{},
+) {
+	sig := <-sigch
+	fmt.Println("Received", sig, "- shutting down")
+	if err := srv.Shutdown(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to close socket:", err)
+	}
+	close(stopped)
+}
 
-	ycfg := yangconfig.NewConfig().IncludeYangDirs(yangdir).
+// compileSchema compiles the YANG in dir. A schema without interfaces,
+// as compiled from an empty or wrong directory, is an error rather than
+// leaving the daemon to mishandle every configuration.
+func compileSchema(dir string) (schema.Node, time.Duration, error) {
+	ycfg := yangconfig.NewConfig().IncludeYangDirs(dir).
 		IncludeFeatures(capabilities).SystemConfig()
 
+	start := time.Now()
 	st, err := schema.CompileDir(
 		&compile.Config{
 			YangLocations: ycfg.YangLocator(),
 			Features:      ycfg.FeaturesChecker(),
 			Filter:        compile.IsConfig},
 		nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to compile YANG in %s: %s",
+			dir, err)
+	}
+	if st.SchemaChild("interfaces") == nil {
+		return nil, 0, fmt.Errorf("YANG in %s defines no interfaces", dir)
+	}
+	return st, time.Since(start), nil
+}
+
+// instanceLock is held for the life of the daemon; keeping it
+// referenced stops the file being closed, and the lock released, when
+// it is garbage collected.
+var instanceLock *os.File
+
+// lockInstance takes an exclusive lock alongside the socket so that a
+// second daemon fails rather than removing the first's socket.
+func lockInstance(socket string) error {
+	f, err := os.OpenFile(socket+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("ifmgrd already running on %s", socket)
+		}
+		return err
+	}
+	instanceLock = f
+	return nil
+}
+
+func listenUnix(path string) (*net.UnixListener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ua, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", ua)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0770); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// waitForConfigd dials the configd socket until it answers or timeout
+// passes.
+func waitForConfigd(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		c, err := net.Dial("unix", path)
+		if err == nil {
+			return c.Close()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("configd unreachable at %s after %s: %s",
+				path, timeout, err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func main() {
+	var err error
+
+	flag.Parse()
+
+	fatal(os.MkdirAll(filepath.Dir(socket), 0755))
+	fatal(lockInstance(socket))
+
+	// From here a signal must not stop the daemon without undoing
+	// its mounts; signals received before the server is running are
+	// acted on once it is.
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+
+	proxysocket := configdsocket
+	if !nomountjuggle {
+		fatal(jugglemounts())
+		proxysocket = newconfigdsocket
+	}
+
+	go sigstartprof()
+
+	st, compileTime, err := compileSchema(yangdir)
+	if err != nil && fallbackyangdir != "" {
+		fmt.Fprintln(os.Stderr, err, "- trying", fallbackyangdir)
+		yangdir = fallbackyangdir
+		st, compileTime, err = compileSchema(yangdir)
+	}
 	fatal(err)
+	fmt.Println("Compiled schema from", yangdir, "in", compileTime)
 
-	ifmgrd.SchemaTree.Store(st)
+	ifmgrd.SchemaTree.StoreCompiled(st, compileTime)
 
 	listeners, err := activation.Listeners(true)
 	fatal(err)
@@ -201,13 +640,66 @@ func main() {
 	l := listeners[0]
 
 	config := &ifmgrd.Config{
-		Yangdir:       yangdir,
-		Socket:        socket,
-		Capabilities:  capabilities,
-		ConfigdSocket: newconfigdsocket,
+		Yangdir:         yangdir,
+		FallbackYangdir: fallbackyangdir,
+		Socket:          socket,
+		Capabilities:    capabilities,
+		ConfigdSocket:   proxysocket,
+
+		ApplyLagThreshold: applylagthreshold,
+		MaxInterfaces:     maxinterfaces,
+		MaxSessions:       maxsessions,
+		MaxCommitOutput:   maxcommitoutput,
+		ApplyTimeout:      applytimeout,
+		ApplyDebounce:     applydebounce,
+		MinCommitInterval: mincommitinterval,
+		AutoRegister:      autoregister,
+		AlwaysShowSecrets: showsecrets,
+		StrictApply:       strictapply,
+		NotifyRate:        notifyrate,
+		NotifyBurst:       notifyburst,
+		NotifyBatch:       notifybatch,
+		RegistrationFile:  registrationfile,
+		DumpDir:           dumpdir,
+		RedactPaths:       splitList(redactpaths),
+		ManageAllowlist:   splitList(manageallowlist),
+		PlugPollInterval:  plugpollinterval,
+		Observe:           observe,
+
+		NeverPluggedTimeout: neverpluggedtimeout,
+		ConnConcurrency:     connconcurrency,
+		AcceptBackoff:       acceptbackoff,
+		AcceptBackoffMax:    acceptbackoffmax,
+
+		TrustedGroups: splitList(trustedgroups),
+	}
+
+	for _, pattern := range config.ManageAllowlist {
+		if _, err := path.Match(pattern, ""); err != nil {
+			fatal(fmt.Errorf("Invalid -manage-allowlist pattern %q: %s",
+				pattern, err))
+		}
+	}
+
+	if eventsocket != "" {
+		el, err := listenUnix(eventsocket)
+		fatal(err)
+		go func() {
+			fatal(ifmgrd.ServeEvents(el))
+		}()
+	}
+
+	if requireconfigd {
+		fatal(waitForConfigd(proxysocket, configdwait))
 	}
 
 	srv := ifmgrd.NewSrv(l.(*net.UnixListener), config)
+	stopped := make(chan struct{})
+	go shutdownOnSignal(srv, sigch, stopped)
 
 	fatal(srv.Serve())
+	<-stopped
+
+	fatal(undomounts())
+	fmt.Println("Shutdown complete")
 }
@@ -19,6 +19,9 @@ Usage:
 		specified, a timeout expired error will be shown, and
 		qa-notify will exit with an error code.
 		When not specified, it defaults to 15 seconds.
+		The timeout covers the whole run. Interrupting qa-notify
+		(SIGINT) stops the wait early, also exiting with an error
+		code.
 
 	verbose
 		Switch on verbose output that can be useful in debugging
@@ -62,9 +65,11 @@ Examples:
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"time"
@@ -281,8 +286,12 @@ func configdMatchesIfmgrd(client *ifmgrd.Client, st schema.Node, cfgTree *data.N
 
 	rn, err := getInterfaceRunning(client, st, intf)
 	if err != nil {
-		//not present in ifmgrd
-		return true, nil
+		managed, lerr := client.ListManaged()
+		if lerr != nil {
+			// can't tell an unmanaged interface from a failure
+			return false, err
+		}
+		return unmanagedAgrees(intf, c, managed), err
 	}
 
 	// Compare configd and ifmgrd view of interface config
@@ -302,7 +311,22 @@ func configdMatchesIfmgrd(client *ifmgrd.Client, st schema.Node, cfgTree *data.N
 	return true, nil
 }
 
-func waitForMatch(wi *WaitInput) error {
+// unmanagedAgrees decides whether configd and ifmgrd agree on an
+// interface whose running configuration ifmgrd did not return. If the
+// interface is not managed ifmgrd legitimately has none, which agrees
+// only if configd has no configuration for it either. Otherwise
+// fetching it failed, and agreement can't be declared until it is
+// fetched.
+func unmanagedAgrees(intf string, configd *data.Node, managed []string) bool {
+	for _, m := range managed {
+		if m == intf {
+			return false
+		}
+	}
+	return configd == nil
+}
+
+func waitForMatch(ctx context.Context, wi *WaitInput) error {
 
 	st, err := schemaGet()
 	if err != nil {
@@ -334,12 +358,9 @@ func waitForMatch(wi *WaitInput) error {
 	if err != nil {
 		return err
 	}
-
-	timeout := make(chan error, 1)
-	go func() {
-		time.Sleep(time.Duration(wi.timeout) * time.Second)
-		timeout <- fmt.Errorf("Timeout expired")
-	}()
+	if managed, err := client.ListManaged(); err == nil {
+		wi.intf = matchManaged(wi.intf, managed, wi.verbose)
+	}
 
 	for {
 		sets := false
@@ -352,7 +373,10 @@ func waitForMatch(wi *WaitInput) error {
 		}
 
 		for _, iface := range wi.intf {
-			r, _ := configdMatchesIfmgrd(client, st, configdtree, iface)
+			r, err := configdMatchesIfmgrd(client, st, configdtree, iface)
+			if err != nil && wi.verbose {
+				fmt.Printf("\nInterface %s: %s\n", iface, err)
+			}
 			if r != true {
 				sets = false
 			}
@@ -368,10 +392,57 @@ func waitForMatch(wi *WaitInput) error {
 			if wi.verbose {
 				fmt.Printf("\nReceived configuration_update notification:\n")
 			}
-		case err = <-timeout:
-			return err
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("Timeout expired")
+			}
+			return fmt.Errorf("Interrupted")
+		}
+	}
+}
+
+// Longest interface name the kernel allows
+const maxIntfNameLen = 15
+
+func checkIntfName(name string) error {
+	switch {
+	case len(name) > maxIntfNameLen:
+		return fmt.Errorf("Invalid interface name %q: longer than %d characters",
+			name, maxIntfNameLen)
+	case strings.ContainsAny(name, "/: \t\n"):
+		return fmt.Errorf("Invalid interface name %q", name)
+	}
+	return nil
+}
+
+// matchManaged corrects the case of interface names that only differ
+// in case from a managed interface. In verbose mode it warns of names
+// not managed at all, which only converge if they are not configured.
+func matchManaged(names, managed []string, verbose bool) []string {
+	isManaged := make(map[string]bool, len(managed))
+	for _, m := range managed {
+		isManaged[m] = true
+	}
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if !isManaged[name] {
+			for _, m := range managed {
+				if strings.EqualFold(name, m) {
+					if verbose {
+						fmt.Printf("\nUsing managed interface %s for %s\n",
+							m, name)
+					}
+					name = m
+					break
+				}
+			}
 		}
+		if !isManaged[name] && verbose {
+			fmt.Printf("\nInterface %s is not managed by ifmgrd\n", name)
+		}
+		out = append(out, name)
 	}
+	return out
 }
 
 func getArgs(args []string) *WaitInput {
@@ -406,7 +477,9 @@ func getArgs(args []string) *WaitInput {
 			case "verbose":
 				verbose = true
 			default:
-				intf = append(intf, b)
+				if name := strings.TrimSpace(b); name != "" {
+					intf = append(intf, name)
+				}
 			}
 		}
 	}
@@ -414,12 +487,38 @@ func getArgs(args []string) *WaitInput {
 	return &WaitInput{set: set, delete: delete, intf: intf, timeout: timeout, verbose: verbose}
 }
 
+// waitContext returns a context that expires after the timeout, or is
+// cancelled early on SIGINT.
+func waitContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
 
 	waitInput = getArgs(args)
-	if err := waitForMatch(waitInput); err != nil {
+	for _, name := range waitInput.intf {
+		if err := checkIntfName(name); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+	ctx, cancel := waitContext(time.Duration(waitInput.timeout) * time.Second)
+	err := waitForMatch(ctx, waitInput)
+	cancel()
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
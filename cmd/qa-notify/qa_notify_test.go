@@ -12,6 +12,8 @@ package main
 
 import (
 	"testing"
+
+	"github.com/danos/config/data"
 )
 
 func checkSplit(t *testing.T, source string, expect []string) {
@@ -173,3 +175,53 @@ func TestMiltipleMixed(t *testing.T) {
 				"def gef"},
 			intf: []string{"dp0s3", "dp0s4"}})
 }
+
+// Interface names are stripped of surrounding white space
+func TestIntfNameTrimmed(t *testing.T) {
+	wi := getArgs([]string{" dp0s3\t", "  "})
+	if len(wi.intf) != 1 || wi.intf[0] != "dp0s3" {
+		t.Fatalf("Interfaces mismatch:  Got: %#v\n Exp: %#v\n",
+			wi.intf, []string{"dp0s3"})
+	}
+}
+
+func TestCheckIntfName(t *testing.T) {
+	for _, name := range []string{"dp0s3", "dp0p1s1.100", "lo"} {
+		if err := checkIntfName(name); err != nil {
+			t.Fatalf("Valid name %q rejected: %s", name, err)
+		}
+	}
+	for _, name := range []string{"dp0 s3", "dp0/s3", "dp0p1s1.1000000000"} {
+		if err := checkIntfName(name); err == nil {
+			t.Fatalf("Invalid name %q accepted", name)
+		}
+	}
+}
+
+// Names differing only in case from a managed interface are corrected
+func TestMatchManaged(t *testing.T) {
+	out := matchManaged([]string{"DP0s3", "dp0s4", "tun8"},
+		[]string{"dp0s3", "dp0s4"}, false)
+	expect := []string{"dp0s3", "dp0s4", "tun8"}
+	for i := range expect {
+		if out[i] != expect[i] {
+			t.Fatalf("Matched names mismatch:  Got: %#v\n Exp: %#v\n",
+				out, expect)
+		}
+	}
+}
+
+// An interface ifmgrd returned no running config for only agrees with
+// configd if it isn't managed and configd has no config for it either
+func TestUnmanagedAgrees(t *testing.T) {
+	managed := []string{"dp0s3"}
+	if unmanagedAgrees("dp0s3", nil, managed) {
+		t.Fatalf("Managed interface without running config agreed")
+	}
+	if !unmanagedAgrees("tun8", nil, managed) {
+		t.Fatalf("Unconfigured unmanaged interface did not agree")
+	}
+	if unmanagedAgrees("tun8", data.New("root"), managed) {
+		t.Fatalf("Configured unmanaged interface agreed")
+	}
+}
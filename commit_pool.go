@@ -6,7 +6,13 @@
 package ifmgrd
 
 import (
+	"fmt"
+	"os"
 	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/danos/config/commit"
 	"github.com/danos/mgmterror"
@@ -22,6 +28,7 @@ func init() {
 }
 
 type commitRequest struct {
+	intf      string
 	committer *Committer
 	resp      chan commitResponse
 }
@@ -32,34 +39,89 @@ type commitResponse struct {
 }
 
 type commitWorker struct {
+	pool     *commitPool
 	requests chan commitRequest
 }
 
 func (w *commitWorker) work() {
-	for {
-		req := <-w.requests
-		outs, errs, _, _ := commit.Commit(req.committer)
-		req.resp <- commitResponse{outs: outs, errs: errs}
+	for req := range w.requests {
+		req.resp <- w.commit(req)
 	}
 }
 
+// commit runs a commit request's actions between its hooks. A panic,
+// from an action or a hook, is logged and returned as the commit's
+// error, so the worker survives and the interface is no longer
+// reported active; the machine records the error and settles rather
+// than retrying a commit that panics.
+func (w *commitWorker) commit(req commitRequest) (resp commitResponse) {
+	running := false
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Commit for %s panicked: %v\n%s",
+				req.intf, r, debug.Stack())
+			metrics.Inc("commit-panics")
+			if running {
+				w.pool.finished(req.intf)
+			}
+			resp = commitResponse{
+				errs: []error{fmt.Errorf("Commit panicked: %v", r)},
+			}
+		}
+	}()
+	hooks := w.pool.commitHooks()
+	if err := hooks.PreCommit(req.intf, req.committer); err != nil {
+		return commitResponse{errs: []error{err}}
+	}
+	w.pool.started(req.intf)
+	running = true
+	outs, errs, _, _ := commit.Commit(req.committer)
+	w.pool.finished(req.intf)
+	running = false
+	hooks.PostCommit(req.intf, req.committer, errs)
+	return commitResponse{outs: outs, errs: errs}
+}
+
+type ActiveCommit struct {
+	Interface string    `json:"interface"`
+	Started   time.Time `json:"started"`
+}
+
 type commitPool struct {
 	work chan commitRequest
+
+	// activeMu also guards hooks
+	activeMu sync.Mutex
+	active   map[string]time.Time
+	hooks    CommitHooks
+
+	// closeMu guards closed; accepted counts the commits accepted
+	// and not yet completed
+	closeMu  sync.RWMutex
+	closed   bool
+	accepted sync.WaitGroup
 }
 
 // A commit pool starts up NumCPU workers to handle commit requests.
 // NumCPU is used as an arbitrary heuristic as to how many parallel
 // requests the system can handle at once.
 //
-// Commits are distributed to these workers for processing.
+// Commits are distributed to these workers for processing. Commits of
+// different interfaces run in parallel, but the actions of a single
+// interface's commit run in turn: commit.Commit orders them by
+// priority and offers no way to run independent actions concurrently,
+// so there is no per-commit parallelism for the Committer to expose.
 func newCommitPool() *commitPool {
 	var nWorker = runtime.NumCPU()
 	b := &commitPool{
-		work: make(chan commitRequest, 100),
+		work:   make(chan commitRequest, 100),
+		active: make(map[string]time.Time),
+		hooks:  noCommitHooks{},
 	}
 
 	for i := 0; i < nWorker; i++ {
 		w := &commitWorker{
+			pool:     b,
 			requests: b.work,
 		}
 		go w.work()
@@ -67,9 +129,81 @@ func newCommitPool() *commitPool {
 	return b
 }
 
-func (b *commitPool) Commit(committer *Committer) (outs []*exec.Output, errs []error) {
+func (b *commitPool) started(intf string) {
+	b.activeMu.Lock()
+	defer b.activeMu.Unlock()
+	b.active[intf] = time.Now()
+}
+
+func (b *commitPool) finished(intf string) {
+	b.activeMu.Lock()
+	defer b.activeMu.Unlock()
+	delete(b.active, intf)
+}
+
+func (b *commitPool) setHooks(hooks CommitHooks) {
+	if hooks == nil {
+		hooks = noCommitHooks{}
+	}
+	b.activeMu.Lock()
+	defer b.activeMu.Unlock()
+	b.hooks = hooks
+}
+
+func (b *commitPool) commitHooks() CommitHooks {
+	b.activeMu.Lock()
+	defer b.activeMu.Unlock()
+	return b.hooks
+}
+
+// Active lists the interfaces with a commit currently executing.
+func (b *commitPool) Active() []*ActiveCommit {
+	b.activeMu.Lock()
+	defer b.activeMu.Unlock()
+	out := make([]*ActiveCommit, 0, len(b.active))
+	for intf, started := range b.active {
+		out = append(out, &ActiveCommit{Interface: intf, Started: started})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Interface < out[j].Interface
+	})
+	return out
+}
+
+// Shutdown stops the pool accepting commits, waits for those already
+// accepted to complete and then stops the workers.
+func (b *commitPool) Shutdown() {
+	b.closeMu.Lock()
+	if b.closed {
+		b.closeMu.Unlock()
+		return
+	}
+	b.closed = true
+	b.closeMu.Unlock()
+
+	b.accepted.Wait()
+	close(b.work)
+}
+
+func (b *commitPool) Commit(
+	intf string,
+	committer *Committer,
+) (outs []*exec.Output, errs []error) {
+	b.closeMu.RLock()
+	if b.closed {
+		b.closeMu.RUnlock()
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = "ifmgrd is shutting down, commit for " + intf +
+			" not run"
+		return nil, []error{err}
+	}
+	b.accepted.Add(1)
+	b.closeMu.RUnlock()
+	defer b.accepted.Done()
+
 	respCh := make(chan commitResponse, 1)
 	b.work <- commitRequest{
+		intf:      intf,
 		committer: committer,
 		resp:      respCh,
 	}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCommitHooks struct {
+	preErr error
+	calls  []string
+}
+
+func (h *testCommitHooks) PreCommit(intf string, _ *Committer) error {
+	h.calls = append(h.calls, "pre "+intf)
+	return h.preErr
+}
+
+func (h *testCommitHooks) PostCommit(intf string, _ *Committer, _ []error) {
+	h.calls = append(h.calls, "post "+intf)
+}
+
+func TestPreCommitFailureSkipsCommit(t *testing.T) {
+	hooks := &testCommitHooks{preErr: errors.New("dataplane busy")}
+	pool := &commitPool{active: make(map[string]time.Time)}
+	pool.setHooks(hooks)
+	w := &commitWorker{pool: pool}
+
+	resp := w.commit(commitRequest{
+		intf:      "tst0s1",
+		committer: NewCommitter(nil, nil, nil, "test"),
+	})
+	if len(resp.errs) != 1 || resp.errs[0] != hooks.preErr {
+		t.Fatalf("Expected PreCommit error, got %v", resp.errs)
+	}
+	if len(hooks.calls) != 1 || hooks.calls[0] != "pre tst0s1" {
+		t.Fatalf("Unexpected hook calls %v", hooks.calls)
+	}
+	if active := pool.Active(); len(active) != 0 {
+		t.Fatalf("Commit left active after PreCommit failure: %v", active)
+	}
+}
+
+type testPanicHooks struct{}
+
+func (testPanicHooks) PreCommit(string, *Committer) error {
+	return nil
+}
+
+func (testPanicHooks) PostCommit(string, *Committer, []error) {
+	panic("commit script exploded")
+}
+
+// A panic on the worker is returned as the commit's error and leaves
+// neither the worker dead nor the interface reported active.
+func TestCommitPanicRecovers(t *testing.T) {
+	pool := &commitPool{active: make(map[string]time.Time)}
+	pool.setHooks(testPanicHooks{})
+	w := &commitWorker{pool: pool}
+
+	resp := w.commit(commitRequest{
+		intf:      "tst0s8",
+		committer: NewCommitter(nil, nil, nil, "test"),
+	})
+	if len(resp.errs) != 1 ||
+		!strings.Contains(resp.errs[0].Error(), "panicked") {
+		t.Fatalf("Expected the panic as the error, got %v", resp.errs)
+	}
+	if active := pool.Active(); len(active) != 0 {
+		t.Fatalf("Commit left active after panic: %v", active)
+	}
+}
+
+func TestNilCommitHooksAreNoops(t *testing.T) {
+	pool := &commitPool{}
+	pool.setHooks(nil)
+	if err := pool.commitHooks().PreCommit("tst0s1", nil); err != nil {
+		t.Fatalf("Default PreCommit failed: %s", err)
+	}
+}
+
+type testBlockingHooks struct {
+	started, release chan struct{}
+}
+
+func (h *testBlockingHooks) PreCommit(string, *Committer) error {
+	close(h.started)
+	<-h.release
+	return nil
+}
+
+func (h *testBlockingHooks) PostCommit(string, *Committer, []error) {}
+
+func TestShutdownWaitsForAcceptedCommits(t *testing.T) {
+	hooks := &testBlockingHooks{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	pool := newCommitPool()
+	pool.setHooks(hooks)
+
+	committed := make(chan []error)
+	go func() {
+		_, errs := pool.Commit("tst0s1", NewCommitter(nil, nil, nil, "test"))
+		committed <- errs
+	}()
+	<-hooks.started
+
+	stopped := make(chan struct{})
+	go func() {
+		pool.Shutdown()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown returned before the commit completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(hooks.release)
+	if errs := <-committed; len(errs) != 0 {
+		t.Fatalf("Accepted commit failed: %v", errs)
+	}
+	<-stopped
+
+	_, errs := pool.Commit("tst0s2", NewCommitter(nil, nil, nil, "test"))
+	if len(errs) != 1 {
+		t.Fatalf("Commit after shutdown returned %v, expected an error",
+			errs)
+	}
+}
+
+type testRejectHooks struct{}
+
+func (testRejectHooks) PreCommit(string, *Committer) error {
+	return errors.New("rejected")
+}
+
+func (testRejectHooks) PostCommit(string, *Committer, []error) {}
+
+// Commits racing a shutdown either run or fail cleanly; none may send
+// on the closed work channel.
+func TestCommitDuringShutdownFailsCleanly(t *testing.T) {
+	pool := newCommitPool()
+	pool.setHooks(testRejectHooks{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs := pool.Commit("tst0s1",
+				NewCommitter(nil, nil, nil, "test"))
+			if len(errs) != 1 {
+				t.Errorf("Commit returned %v, expected one error", errs)
+			}
+		}()
+	}
+	pool.Shutdown()
+	wg.Wait()
+
+	_, errs := pool.Commit("tst0s2", NewCommitter(nil, nil, nil, "test"))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "shutting down") {
+		t.Fatalf("Commit after shutdown returned %v, expected shutdown error",
+			errs)
+	}
+	// a second shutdown must not close the work channel again
+	pool.Shutdown()
+}
@@ -14,15 +14,33 @@ import (
 
 	"github.com/danos/config/commit"
 	"github.com/danos/config/data"
+	"github.com/danos/config/diff"
 	"github.com/danos/config/schema"
 )
 
+// CommitHooks lets deployments run their own steps around the commit
+// actions for an interface, for example holding a dataplane lock for
+// the duration of the commit. If PreCommit fails the commit actions
+// are not run and the error is reported as a commit error. PostCommit
+// is called with the commit errors whenever PreCommit succeeded.
+type CommitHooks interface {
+	PreCommit(intf string, c *Committer) error
+	PostCommit(intf string, c *Committer, errs []error)
+}
+
+type noCommitHooks struct{}
+
+func (noCommitHooks) PreCommit(string, *Committer) error     { return nil }
+func (noCommitHooks) PostCommit(string, *Committer, []error) {}
+
 type Committer struct {
 	candidate *data.Node
 	running   *data.Node
 	schema    schema.Node
 	sid       string
 	debug     bool
+	// output of the commit actions, set once they have run
+	output string
 }
 
 func NewCommitter(
@@ -80,6 +98,145 @@ func (c *Committer) Effective() commit.EffectiveDatabase {
 	return c
 }
 
+type CommitAction struct {
+	Path   []string `json:"path"`
+	Phase  string   `json:"phase"`
+	Script string   `json:"script"`
+}
+
+// Actions lists the configd commit action scripts that committing
+// the candidate over the running configuration would run, in
+// configuration tree order. Each changed node lists its begin actions,
+// then its create, delete or update actions, the actions of its
+// descendants and finally its end actions. configd reorders subtrees
+// by their priority when committing, which is not reflected here, so
+// the list is not necessarily the order the actions run in. Unless
+// showSecrets is set the values of secret leaves are hidden in the
+// paths reported; the values of nodes the redactor always hides are
+// hidden regardless.
+func (c *Committer) Actions(showSecrets bool, r *redactor) []*CommitAction {
+	out := make([]*CommitAction, 0)
+	root := diff.NewNode(c.candidate, c.running, c.schema, nil)
+	return appendActions(out, root, nil, false, showSecrets, r)
+}
+
+func appendActions(
+	out []*CommitAction,
+	n *diff.Node,
+	path []string,
+	secret, showSecrets bool,
+	r *redactor,
+) []*CommitAction {
+	for _, ch := range n.Children() {
+		if !ch.Added() && !ch.Deleted() && !ch.Updated() && !ch.Changed() {
+			continue
+		}
+		name := ch.Name()
+		if (secret && !showSecrets) || r.matches(path) {
+			name = redactedValue
+		}
+		chpath := append(path[:len(path):len(path)], name)
+		var ext *schema.ConfigdExt
+		if sn := ch.Schema(); sn != nil {
+			ext = sn.ConfigdExt()
+		}
+		if ext == nil {
+			ext = &schema.ConfigdExt{}
+		}
+		add := func(phase string, scripts []string) {
+			for _, script := range scripts {
+				out = append(out, &CommitAction{
+					Path:   chpath,
+					Phase:  phase,
+					Script: script,
+				})
+			}
+		}
+		add("begin", ext.Begin)
+		switch {
+		case ch.Added():
+			add("create", ext.Create)
+		case ch.Deleted():
+			add("delete", ext.Delete)
+		case ch.Updated():
+			add("update", ext.Update)
+		}
+		out = appendActions(out, ch, chpath, ext.Secret, showSecrets, r)
+		add("end", ext.End)
+	}
+	return out
+}
+
+// DiffNode is a changed node of the configuration. Leaves and
+// leaf-lists report their values in Old and New rather than as
+// children.
+type DiffNode struct {
+	Name     string      `json:"name"`
+	Op       string      `json:"op"`
+	Old      []string    `json:"old,omitempty"`
+	New      []string    `json:"new,omitempty"`
+	Children []*DiffNode `json:"children,omitempty"`
+}
+
+// Diff returns the changes committing the candidate over the running
+// configuration would make, as a tree of the nodes added, deleted or
+// changed. Values are hidden as they are by Actions.
+func (c *Committer) Diff(showSecrets bool, r *redactor) []*DiffNode {
+	root := diff.NewNode(c.candidate, c.running, c.schema, nil)
+	return diffChildren(root, nil, showSecrets, r)
+}
+
+func diffChildren(
+	n *diff.Node,
+	path []string,
+	showSecrets bool,
+	r *redactor,
+) []*DiffNode {
+	out := make([]*DiffNode, 0)
+	for _, ch := range n.Children() {
+		var op string
+		switch {
+		case ch.Added():
+			op = "added"
+		case ch.Deleted():
+			op = "deleted"
+		case ch.Updated(), ch.Changed():
+			op = "changed"
+		default:
+			continue
+		}
+		chpath := append(path[:len(path):len(path)], ch.Name())
+		dn := &DiffNode{Name: ch.Name(), Op: op}
+		out = append(out, dn)
+
+		sn := ch.Schema()
+		_, isLeaf := sn.(schema.Leaf)
+		_, isLeafList := sn.(schema.LeafList)
+		if !isLeaf && !isLeafList {
+			dn.Children = diffChildren(ch, chpath, showSecrets, r)
+			continue
+		}
+		secret := false
+		if ext := sn.ConfigdExt(); ext != nil {
+			secret = ext.Secret
+		}
+		hide := r.matches(chpath) || (secret && !showSecrets)
+		for _, val := range ch.Children() {
+			name := val.Name()
+			if hide {
+				name = redactedValue
+			}
+			switch {
+			case op == "added" || val.Added():
+				dn.New = append(dn.New, name)
+			case op == "deleted" || val.Deleted():
+				dn.Old = append(dn.Old, name)
+			}
+		}
+	}
+	return out
+}
+
 //commit.EffectiveDatabase
 func (c *Committer) Set(_ []string) error {
 	return nil
@@ -20,6 +20,7 @@ import (
 	"syscall"
 
 	client "github.com/danos/configd/client"
+	"github.com/danos/mgmterror"
 	"github.com/danos/utils/audit"
 	"github.com/danos/utils/os/group"
 )
@@ -78,6 +79,8 @@ type SrvConn struct {
 	enc     *json.Encoder
 	dec     *json.Decoder
 	sending *sync.Mutex
+	// operations the caller may perform
+	perms Permission
 }
 
 //Send an rpc response with appropriate data or an error
@@ -125,25 +128,49 @@ func (conn *SrvConn) getCreds() (*syscall.Ucred, error) {
 //and returns the response to the client.
 func (conn *SrvConn) Handle() {
 
-	var secrets bool
+	secrets := conn.srv.Config.AlwaysShowSecrets
+	trusted := len(conn.srv.trustedGroups) == 0
+	mapper := conn.srv.Config.Permissions
+	if mapper == nil {
+		mapper = defaultPermissions{}
+	}
 
-	cred, err := conn.getCreds()
+	var cred *syscall.Ucred
+	var groupNames []string
+	var err error
+	// Skip the lookups when nothing depends on who the caller is
+	if !secrets || !trusted || conn.srv.Config.Permissions != nil {
+		cred, err = conn.getCreds()
+	}
 	if err != nil {
 		if !IsLoginPidError(err) {
 			fmt.Fprintln(os.Stderr, err)
 		}
-	} else {
+		cred = nil
+	} else if cred != nil {
+		conn.cred = cred
+		if cred.Uid == 0 {
+			trusted = true
+		}
 		groups, err := group.LookupUid(strconv.Itoa(int(cred.Uid)))
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		} else {
 			for _, gr := range groups {
-				if gr.Name == "secrets" {
-					secrets = true
+				groupNames = append(groupNames, gr.Name)
+				if conn.srv.isTrustedGroup(gr.Name) {
+					trusted = true
 				}
 			}
 		}
 	}
+	conn.perms = mapper.Permissions(cred, groupNames)
+	if !trusted {
+		conn.perms &= PermRead | PermSecrets
+	}
+	if conn.perms&PermSecrets != 0 {
+		secrets = true
+	}
 
 	client, err := client.Dial("unix", conn.srv.Config.ConfigdSocket, "RUNNING")
 	if err != nil {
@@ -155,37 +182,181 @@ func (conn *SrvConn) Handle() {
 		secrets: secrets,
 	}
 
-	for {
-		req, err := conn.readRequest()
-		if err != nil {
-			if err != io.EOF {
-				conn.srv.LogError(err)
+	limit := conn.srv.Config.ConnConcurrency
+	if limit <= 1 {
+		for {
+			req, err := conn.readRequest()
+			if err != nil {
+				conn.logReadError(err)
+				break
+			}
+			if err := conn.serve(disp, req); err != nil {
+				break
 			}
-			break
 		}
+		conn.Close()
+		return
+	}
 
-		result, err := conn.Call(disp, req.Method, req.Args)
-		err = conn.sendResponse(newResponse(result, err, req.Id))
+	// Handle up to limit requests at once. Responses are sent as each
+	// completes, so may be out of order; clients match them to requests
+	// by Id.
+	var wg sync.WaitGroup
+	var configd sync.Mutex
+	sem := make(chan struct{}, limit)
+	for {
+		req, err := conn.readRequest()
 		if err != nil {
+			conn.logReadError(err)
 			break
 		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// the configd client handles one call at a time
+			if _, ok := configdMethods[req.Method]; ok {
+				configd.Lock()
+				defer configd.Unlock()
+			}
+			if err := conn.serve(disp, req); err != nil {
+				// stops the read loop
+				conn.Close()
+			}
+		}()
 	}
+	wg.Wait()
 	conn.Close()
 	return
 }
 
-func (conn *SrvConn) Call(
-	disp *Disp,
-	method string,
-	args []interface{},
-) (interface{}, error) {
-	m, ok := conn.srv.m[method]
+// serve calls the requested method and sends its response.
+func (conn *SrvConn) serve(disp *Disp, req *Request) error {
+	result, err := conn.Call(disp, req.Method, req.Args)
+	return conn.sendResponse(newResponse(result, err, req.Id))
+}
+
+// configdMethods are the methods calling configd through the
+// connection's configd client.
+var configdMethods = map[string]struct{}{
+	"SyncFromConfigd":    {},
+	"ConfigdTreeGet":     {},
+	"NodeGetType":        {},
+	"TmplGet":            {},
+	"TmplGetChildren":    {},
+	"TmplValidatePath":   {},
+	"TmplValidateValues": {},
+	"SchemaGet":          {},
+	"GetSchemas":         {},
+	"ReadConfigFile":     {},
+	"CallRpc":            {},
+	"CallRpcXml":         {},
+	"MigrateConfigFile":  {},
+	"Expand":             {},
+}
+
+// peer identifies the client for logging
+func (conn *SrvConn) peer() string {
+	if conn.cred == nil {
+		return "unknown client"
+	}
+	return fmt.Sprintf("client pid %d uid %d", conn.cred.Pid, conn.cred.Uid)
+}
+
+func (conn *SrvConn) logReadError(err error) {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		fmt.Fprintf(os.Stderr, "Malformed request from %s: %s\n",
+			conn.peer(), err)
+		return
+	}
+	switch err {
+	case io.EOF:
+		// clean disconnect between requests
+	case io.ErrUnexpectedEOF:
+		fmt.Fprintf(os.Stderr, "Request from %s cut short by disconnect\n",
+			conn.peer())
+	default:
+		fmt.Fprintf(os.Stderr, "Error reading request from %s: %s\n",
+			conn.peer(), err)
+	}
+}
+
+var stringsType = reflect.TypeOf([]string(nil))
+
+// stringsArg converts a JSON array of strings, which is decoded as
+// []interface{}, to the []string a method expects. A JSON null is an
+// empty list.
+func stringsArg(v interface{}) ([]string, bool) {
+	if v == nil {
+		return nil, true
+	}
+	is, ok := v.([]interface{})
 	if !ok {
-		return nil, &MethErr{Name: method}
+		return nil, false
+	}
+	out := make([]string, 0, len(is))
+	for _, i := range is {
+		s, ok := i.(string)
+		if !ok {
+			return nil, false
+		}
+		out = append(out, s)
 	}
+	return out, true
+}
 
-	typ := m.Func.Type()
+// configArgs gives the position of the argument of each method that
+// carries a JSON configuration. Clients may send it as a JSON object
+// rather than a string holding one.
+var configArgs = map[string]int{
+	"Apply":          0,
+	"ApplyWithTxn":   0,
+	"ApplyInterface": 1,
+	"ApplyCAS":       2,
+}
 
+// configArg returns a configuration argument as the JSON string the
+// method expects, re-marshaling one sent as an object.
+func configArg(method string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}:
+		out, err := json.Marshal(v)
+		return string(out), err
+	}
+	return "", fmt.Errorf(
+		"%s expects the configuration as a JSON string or object, got %s",
+		method, jsonTypeName(v))
+}
+
+// jsonTypeName names the JSON type an argument was decoded from.
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// callArgs validates a request's arguments against the method's type,
+// returning them converted for the call with disp as the receiver.
+func callArgs(
+	disp *Disp,
+	method string,
+	typ reflect.Type,
+	args []interface{},
+) ([]reflect.Value, error) {
 	//Number of args are equal?
 	if len(args) != typ.NumIn()-1 {
 		return nil, &ArgNErr{
@@ -202,6 +373,28 @@ func (conn *SrvConn) Call(
 	for i, v := range args {
 		t1 := reflect.TypeOf(v)
 		t2 := typ.In(i + 1)
+		if pos, ok := configArgs[method]; ok && pos == i {
+			s, err := configArg(method, v)
+			if err != nil {
+				return nil, err
+			}
+			vals[i+1] = reflect.ValueOf(s)
+			continue
+		}
+		if t2 == stringsType {
+			if s, ok := stringsArg(v); ok {
+				vals[i+1] = reflect.ValueOf(s)
+				continue
+			}
+		}
+		if t1 == nil {
+			return nil, &ArgErr{
+				Method: method,
+				Farg:   v,
+				Typ:    jsonTypeName(v),
+				Etyp:   t2.Name(),
+			}
+		}
 		if t1 != t2 {
 			if !t1.ConvertibleTo(t2) {
 				return nil, &ArgErr{
@@ -216,10 +409,47 @@ func (conn *SrvConn) Call(
 			vals[i+1] = reflect.ValueOf(v)
 		}
 	}
+	return vals, nil
+}
+
+func (conn *SrvConn) Call(
+	disp *Disp,
+	method string,
+	args []interface{},
+) (interface{}, error) {
+	m, ok := conn.srv.m[method]
+	if !ok {
+		return nil, &MethErr{Name: method}
+	}
+
+	if need := requiredPermission(method); conn.perms&need != need {
+		err := mgmterror.NewAccessDeniedApplicationError()
+		err.Message = fmt.Sprintf(
+			"Not permitted to call %s: %s permission needed", method, need)
+		return nil, err
+	}
+
+	if !SchemaTree.Ready() {
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = "ifmgrd is starting, schema not yet loaded, try again"
+		return nil, err
+	}
+	unpin, ok := SchemaTree.pin()
+	if !ok {
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = "Schema reload in progress, try again"
+		return nil, err
+	}
+	defer unpin()
+
+	vals, err := callArgs(disp, method, m.Func.Type(), args)
+	if err != nil {
+		return nil, err
+	}
 
 	//call the function
 	rets := m.Func.Call(vals)
-	err, ok := rets[1].Interface().(error)
+	err, ok = rets[1].Interface().(error)
 	if ok {
 		return rets[0].Interface(), err
 	} else {
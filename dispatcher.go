@@ -9,6 +9,16 @@
 package ifmgrd
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danos/config/data"
 	"github.com/danos/config/diff"
 	"github.com/danos/config/schema"
 	"github.com/danos/config/union"
@@ -37,20 +47,298 @@ func (d *Disp) validatePath(ps []string) error {
 	return nil
 }
 
+// interfacesPath rejects a path outside the interfaces subtree, for
+// queries of trees holding only an interface's configuration, where
+// such a path could only ever be reported missing. Session queries
+// aren't restricted: sessions hold the whole configuration so that
+// commit actions can refer to configuration outside interfaces.
+func interfacesPath(ps []string) error {
+	if len(ps) > 0 && ps[0] == "interfaces" {
+		return nil
+	}
+	err := mgmterror.NewInvalidValueApplicationError()
+	err.Message = fmt.Sprintf(
+		"%s is not interface configuration; paths must start with /interfaces",
+		pathutil.Pathstr(ps))
+	return err
+}
+
 //ifmgrd specific
 func (d *Disp) Apply(config string) (bool, error) {
+	return d.ApplyWithTxn(config, "")
+}
+
+// Apply configuration identified by a caller's transaction id, such as
+// that of the configd commit it came from. The id is reported in the
+// configuration-updated notifications and operational state of the
+// interfaces it updates.
+func (d *Disp) ApplyWithTxn(config, txnid string) (bool, error) {
+	dtree, err := parseConfig(config)
+	if err != nil {
+		return false, err
+	}
+	intfmgr.ApplyTxn(dtree, txnid)
+	return true, nil
+}
+
+// Apply the configuration of a single interface, leaving every other
+// interface's configuration as last applied. The configuration may
+// contain other interfaces, which are ignored.
+func (d *Disp) ApplyInterface(intf, config string) (bool, error) {
+	dtree, err := parseConfig(config)
+	if err != nil {
+		return false, err
+	}
+	if !intfmgr.ApplyInterface(intf, dtree) {
+		err := mgmterror.NewInvalidValueApplicationError()
+		err.Message = "Interface " + intf + " is not in the configuration"
+		return false, err
+	}
+	return true, nil
+}
+
+// Apply the configuration of a single interface, as ApplyInterface
+// does, only if the interface's apply generation is still
+// expectedGeneration. Returns false, without applying, if another
+// update has changed the interface's configuration since the caller
+// read the generation.
+func (d *Disp) ApplyCAS(
+	intf string,
+	expectedGeneration int,
+	config string,
+) (bool, error) {
+	dtree, err := parseConfig(config)
+	if err != nil {
+		return false, err
+	}
+	applied, found := intfmgr.ApplyInterfaceCAS(
+		intf, expectedGeneration, dtree)
+	if !found {
+		err := mgmterror.NewInvalidValueApplicationError()
+		err.Message = "Interface " + intf + " is not in the configuration"
+		return false, err
+	}
+	return applied, nil
+}
+
+// Get the apply generation of an interface, which increases each time
+// its configuration changes, for use with ApplyCAS.
+func (d *Disp) ApplyGeneration(intf string) (int, error) {
+	return intfmgr.applyGeneration(intf), nil
+}
+
+// parseConfig unmarshals configuration to be applied. Interfaces
+// configuration unknown to the schema, including whole interface
+// types, is logged and left out, or rejected if applies are strict.
+func parseConfig(config string) (*data.Node, error) {
+	// Report syntax errors with their position rather than as a
+	// schema error from the unmarshal below.
+	var syntax interface{}
+	if err := json.Unmarshal([]byte(config), &syntax); err != nil {
+		merr := mgmterror.NewInvalidValueApplicationError()
+		merr.Message = "Configuration is not valid JSON: " + err.Error()
+		return nil, merr
+	}
 	st := SchemaTree.Load()
 	ut, err := union.UnmarshalJSONWithoutValidation(st, []byte(config))
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	dtree := ut.Merge()
-	intfmgr.Apply(dtree)
-	return true, nil
+	if missing := unknownConfigPaths(st, syntax); len(missing) != 0 {
+		// Nodes unknown to the schema are dropped by the unmarshal,
+		// usually because configd has loaded newer YANG or
+		// capabilities than ifmgrd, as after a partial upgrade.
+		metrics.Inc("applies-schema-mismatch")
+		msg := fmt.Sprintf("Configuration nodes not in ifmgrd's "+
+			"schema, check ifmgrd's YANG and capabilities match "+
+			"configd's: %s", strings.Join(missing, ", "))
+		if intfmgr.settings().StrictApply {
+			i := strings.LastIndex(missing[0], "/")
+			err := mgmterror.NewUnknownElementApplicationError(
+				missing[0][i+1:])
+			err.Path = missing[0][:i]
+			err.Message = msg
+			return nil, err
+		}
+		fmt.Fprintln(os.Stderr, msg, "- they will not be applied")
+	}
+	return dtree, nil
+}
+
+// unknownConfigPaths lists the paths of interfaces configuration,
+// parsed from configd's JSON encoding, that are unknown to the schema.
+// List entries are identified by their tagnode.
+func unknownConfigPaths(st schema.Node, config interface{}) []string {
+	top, _ := config.(map[string]interface{})
+	intfs, ok := top["interfaces"]
+	if !ok {
+		return nil
+	}
+	isn := st.SchemaChild("interfaces")
+	if isn == nil {
+		return []string{"/interfaces"}
+	}
+	return appendUnknownPaths(nil, isn, intfs, []string{"interfaces"})
+}
+
+func appendUnknownPaths(
+	out []string,
+	sn schema.Node,
+	v interface{},
+	path []string,
+) []string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			chpath := append(append([]string{}, path...), name)
+			csn := sn.SchemaChild(name)
+			if csn == nil {
+				out = append(out, pathutil.Pathstr(chpath))
+				continue
+			}
+			out = appendUnknownPaths(out, csn, v[name], chpath)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			// leaf-list values are not checked
+			entry, ok := elem.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			tag, _ := entry["tagnode"].(string)
+			esn := sn.SchemaChild(tag)
+			if esn == nil {
+				continue
+			}
+			chpath := append(append([]string{}, path...), tag)
+			out = appendUnknownPaths(out, esn, entry, chpath)
+		}
+	}
+	return out
+}
+
+// Fetch configd's running configuration and apply it, recovering from
+// a missed push without the caller having to talk to configd.
+//
+// The running configuration is used rather than the candidate that
+// ifmgrctl apply pushes. ifmgrd's configd connection is not part of a
+// configuration session, so has no candidate of a commit in progress
+// to read; outside of a commit running is what configd has applied.
+func (d *Disp) SyncFromConfigd() (bool, error) {
+	if d.client == nil {
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = "Not connected to configd"
+		return false, err
+	}
+	config, err := d.client.TreeGet(rpc.RUNNING, "", "json")
+	if err != nil {
+		return false, err
+	}
+	return d.Apply(config)
+}
+
+type ApplyLag struct {
+	MaxLag    float64  `json:"max-lag-seconds"`
+	Interface string   `json:"interface,omitempty"`
+	Stalled   []string `json:"stalled"`
+}
+
+// Report how far ifmgrd is behind the configuration it has received
+func (d *Disp) MaxApplyLag() (string, error) {
+	lag, intf := intfmgr.maxApplyLag()
+	out, err := json.Marshal(&ApplyLag{
+		MaxLag:    lag.Seconds(),
+		Interface: intf,
+		Stalled:   intfmgr.stalledApplies(),
+	})
+	return string(out), err
+}
+
+func (d *Disp) Stats() (string, error) {
+	var stats Stats
+	intfmgr.stats(&stats)
+	sessionmgr.stats(&stats)
+	out, err := json.Marshal(&stats)
+	return string(out), err
+}
+
+// List the interfaces whose commit is currently executing
+func (d *Disp) ListCommits() (string, error) {
+	out, err := json.Marshal(commitWorkers.Active())
+	return string(out), err
+}
+
+// List the events handled in each state of the interface state machine
+func (d *Disp) Transitions() (string, error) {
+	out, err := json.Marshal(transitions())
+	return string(out), err
+}
+
+// Render the interface state machine's transitions as a Graphviz DOT
+// digraph
+func (d *Disp) StateGraph() (string, error) {
+	return stateGraph(), nil
+}
+
+// Report the messages waiting to be received by each interface's state
+// machine, to tell a slow commit from a flood of messages.
+func (d *Disp) QueueDepths() (string, error) {
+	out, err := json.Marshal(intfmgr.queueDepths())
+	return string(out), err
+}
+
+func (d *Disp) Metrics() (string, error) {
+	out, err := json.Marshal(metrics)
+	return string(out), err
+}
+
+func (d *Disp) ListManaged() ([]string, error) {
+	return intfmgr.managedInterfaces(), nil
+}
+
+// Count configured, managed and plugged interfaces for each interface
+// type known to the schema.
+func (d *Disp) TypeSummary() (string, error) {
+	types := make([]string, 0)
+	intfs := SchemaTree.Load().SchemaChild("interfaces")
+	if intfs != nil {
+		for _, ch := range intfs.Children() {
+			types = append(types, ch.Name())
+		}
+	}
+	sort.Strings(types)
+
+	out, err := json.Marshal(intfmgr.typeSummary(types))
+	return string(out), err
+}
+
+// Report whether every managed interface has settled with its
+// configuration applied.
+func (d *Disp) AllConverged() (bool, error) {
+	return len(intfmgr.pendingInterfaces()) == 0, nil
+}
+
+// List the managed interfaces still applying configuration.
+func (d *Disp) PendingInterfaces() ([]string, error) {
+	return intfmgr.pendingInterfaces(), nil
+}
+
+// List the managed interfaces whose commit actions are running, what
+// ifmgrd is busy with right now.
+func (d *Disp) Applying() ([]string, error) {
+	return intfmgr.applyingInterfaces(), nil
 }
 
 func (d *Disp) Register(intfName string) (bool, error) {
-	intfmgr.Register(intfName)
+	if err := intfmgr.Register(intfName); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -59,53 +347,373 @@ func (d *Disp) Unregister(intfName string) (bool, error) {
 	return true, nil
 }
 
+// Remove the configuration applied to an interface and stop managing
+// it, returning once the configuration has been removed. The interface
+// is not managed again until it is registered.
+func (d *Disp) Decommission(intfName string) (bool, error) {
+	if !intfmgr.Decommission(intfName) {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return false, err
+	}
+	return true, nil
+}
+
+// Remove the configuration applied to an interface while continuing to
+// manage it, so the next configuration applied with it configures it
+// again.
+func (d *Disp) ResetInterface(intfName string) (bool, error) {
+	if !intfmgr.ResetInterface(intfName) {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return false, err
+	}
+	return true, nil
+}
+
 func (d *Disp) Plug(intfName string) (bool, error) {
 	intfmgr.Plug(intfName)
 	return true, nil
 }
 
+// Plug an interface, giving the reason or source of the plug, such as
+// udev or netlink, for the log and interface-state notification.
+func (d *Disp) PlugWithReason(intfName, reason string) (bool, error) {
+	intfmgr.PlugReason(intfName, reason)
+	return true, nil
+}
+
 func (d *Disp) Unplug(intfName string) (bool, error) {
 	intfmgr.Unplug(intfName)
 	return true, nil
 }
 
+// Unplug an interface, giving the reason or source of the unplug.
+func (d *Disp) UnplugWithReason(intfName, reason string) (bool, error) {
+	intfmgr.UnplugReason(intfName, reason)
+	return true, nil
+}
+
+// Re-run the commit actions for an interface's running configuration
+// to recover from changes made to the dataplane outside of ifmgrd.
+// Only a plugged interface with no commit in progress is reconciled.
+func (d *Disp) Reconcile(intfName string) (bool, error) {
+	if !intfmgr.Reconcile(intfName) {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return false, err
+	}
+	return true, nil
+}
+
+// Clear an interface's last commit error after fixing its cause,
+// optionally re-applying its running configuration.
+func (d *Disp) ClearError(intfName string, reapply bool) (bool, error) {
+	if !intfmgr.ClearError(intfName, reapply) {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return false, err
+	}
+	return true, nil
+}
+
+// Get an interface's ifmgr-state operational state as RFC7951 JSON,
+// for configd's state data.
+func (d *Disp) OperationalState(intfName string) (string, error) {
+	state, managed := intfmgr.operationalState(intfName)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return "", err
+	}
+	out, err := json.Marshal(map[string]*OperationalState{
+		"vyatta-ifmgr-v1:ifmgr-state": state,
+	})
+	return string(out), err
+}
+
+// Report the state of an interface's state machine, such as Plugged or
+// Applying, to poll for an interface settling or find one stuck.
+func (d *Disp) InterfaceState(intfName string) (string, error) {
+	state, managed := intfmgr.interfaceState(intfName)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return "", err
+	}
+	return state.String(), nil
+}
+
+// Report the state of each named interface, or of every managed
+// interface if names is empty, in one call.
+func (d *Disp) InterfaceStates(names []string) (map[string]string, error) {
+	states, unmanaged := intfmgr.interfaceStates(names)
+	if unmanaged != "" {
+		err := mgmterror.NewDataMissingError()
+		err.Message = fmt.Sprintf(
+			"Interface %s not managed by ifmgrd", unmanaged)
+		return nil, err
+	}
+	return states, nil
+}
+
+// Preview the configd commit action scripts that applying an
+// interface's candidate configuration would run, for reviewing risky
+// changes before they are applied.
+func (d *Disp) CommitActions(intfName string) (string, error) {
+	committer, managed := intfmgr.committer(intfName)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return "", err
+	}
+	redact := newRedactor(intfmgr.settings().RedactPaths)
+	out, err := json.Marshal(committer.Actions(d.secrets, redact))
+	return string(out), err
+}
+
+// Report the changes committing an interface's candidate configuration
+// would make, as a JSON tree of the nodes added, deleted or changed
+// with their old and new values, for tools that would otherwise parse
+// the text diff.
+func (d *Disp) DiffJSON(intfName string) (string, error) {
+	committer, managed := intfmgr.committer(intfName)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return "", err
+	}
+	redact := newRedactor(intfmgr.settings().RedactPaths)
+	out, err := json.Marshal(committer.Diff(d.secrets, redact))
+	return string(out), err
+}
+
+// Get the output of the commit actions of an interface's most recent
+// successful commit, the status scripts report when they succeed. The
+// output can't be redacted, so is only available to trusted callers.
+func (d *Disp) LastOutput(intfName string) (string, error) {
+	out, managed := intfmgr.lastOutput(intfName)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return "", err
+	}
+	return out, nil
+}
+
+// Report an interface's state and how long it has been in it. A
+// machine applying for minutes is likely stuck.
+func (d *Disp) TimeInState(intfName string) (string, error) {
+	tis, managed := intfmgr.timeInState(intfName)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return "", err
+	}
+	out, err := json.Marshal(tis)
+	return string(out), err
+}
+
+// Report percentiles of how long an interface's recent commits took,
+// to find the interfaces whose commit actions are slow.
+func (d *Disp) LatencyStats(intfName string) (string, error) {
+	stats, managed := intfmgr.latencyStats(intfName)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return "", err
+	}
+	out, err := json.Marshal(stats)
+	return string(out), err
+}
+
+// Report counts of an interface's applies, resets, plug and unplug
+// events and failed commits since it was registered, to pinpoint an
+// interface that is flapping or failing.
+func (d *Disp) InterfaceCounters(intfName string) (string, error) {
+	counters, managed := intfmgr.interfaceCounters(intfName)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return "", err
+	}
+	out, err := json.Marshal(counters)
+	return string(out), err
+}
+
+// Get the configuration the daemon is running with, after flags and
+// defaults have been applied, as JSON.
+func (d *Disp) DaemonConfig() (string, error) {
+	out, err := json.Marshal(intfmgr.settings().effective())
+	return string(out), err
+}
+
+func getSession(sid string) (*Session, error) {
+	session := sessionmgr.Get(sid)
+	if session == nil {
+		// session may be removed when its interface stops being managed
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Session does not exist"
+		return nil, err
+	}
+	return session, nil
+}
+
 //Pretend to be configd for anything started in this session.
 //For this to work we need to start in a new mount namespace.
-func (d *Disp) getTree(db rpc.DB, sid string) union.Node {
-	session := sessionmgr.Get(sid)
+func (d *Disp) getTree(db rpc.DB, sid string) (union.Node, error) {
+	session, err := getSession(sid)
+	if err != nil {
+		return nil, err
+	}
 	switch db {
 	case rpc.EFFECTIVE, rpc.AUTO, rpc.CANDIDATE:
 		return union.NewNode(
-			session.candidate, nil, SchemaTree.Load(), nil, 0)
+			session.candidate, nil, SchemaTree.Load(), nil, 0), nil
 	}
 	return union.NewNode(
-		session.running, nil, SchemaTree.Load(), nil, 0)
+		session.running, nil, SchemaTree.Load(), nil, 0), nil
 }
 
 func (d *Disp) Get(db rpc.DB, sid string, path string) ([]string, error) {
-	return d.getTree(db, sid).Get(nil, pathutil.Makepath(path))
+	ut, err := d.getTree(db, sid)
+	if err != nil {
+		return nil, err
+	}
+	return ut.Get(nil, pathutil.Makepath(path))
 }
 
 // Get an interfaces running configuration
 func (d *Disp) Running(intf string) (string, error) {
-	sid := intfmgr.newSession(intf)
-	if sid == "" {
+	return d.running(intf, false)
+}
+
+// Get an interfaces running configuration including defaults, as seen
+// by the commit actions.
+func (d *Disp) RunningEffective(intf string) (string, error) {
+	return d.running(intf, true)
+}
+
+// Check whether a path exists in an interface's running
+// configuration, without fetching the whole tree to walk it.
+func (d *Disp) RunningExists(intf, path string) (bool, error) {
+	ps := pathutil.Makepath(path)
+	if err := interfacesPath(ps); err != nil {
+		return false, err
+	}
+	if err := d.validatePath(ps); err != nil {
+		return false, err
+	}
+	running, managed := intfmgr.running(intf)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return false, err
+	}
+	if running == nil {
+		return false, nil
+	}
+	ut := union.NewNode(running, nil, SchemaTree.Load(), nil, 0)
+	return ut.Exists(nil, ps) == nil, nil
+}
+
+// running marshals the interface's running tree directly rather than
+// through a session, so frequent polling doesn't contend on the
+// session map.
+func (d *Disp) running(intf string, defaults bool) (string, error) {
+	running, managed := intfmgr.running(intf)
+	if !managed {
 		// interface not currently managed by ifmgr
 		// pending configuration changes may change that.
 		err := mgmterror.NewDataMissingError()
 		err.Message = "Interface not managed by ifmgrd"
 		return "", err
 	}
-	defer sessionmgr.Delete(sid)
-
-	var opts map[string]interface{}
+	return d.marshalConfig(running, defaults)
+}
 
+// marshalConfig marshals a configuration tree as JSON, hiding
+// secrets unless the caller may see them.
+func (d *Disp) marshalConfig(tree *data.Node, defaults bool) (string, error) {
+	flags := make(map[string]interface{})
 	if d.secrets {
-		opts = make(map[string]interface{})
-		opts["Secrets"] = true
+		flags["Secrets"] = true
 	}
+	if defaults {
+		flags["Defaults"] = true
+	}
+
+	ut := union.NewNode(tree, nil, SchemaTree.Load(), nil, 0)
+	return ut.Marshal("data", "json", treeOptions(flags, d.secrets)...)
+}
 
-	return d.TreeGet(rpc.RUNNING, sid, "/", "json", opts)
+// Get the whole configuration last applied to ifmgrd, as received from
+// configd, regardless of which interfaces it is applied to.
+func (d *Disp) ManagerConfig() (string, error) {
+	config := intfmgr.lastConfig()
+	if config == nil {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "No configuration has been applied"
+		return "", err
+	}
+	return d.marshalConfig(config, false)
+}
+
+// Get an interface's candidate and running configuration together,
+// keyed by "candidate" and "running". Both are taken from the same
+// snapshot of the interface's state machine so they cannot straddle
+// an apply.
+func (d *Disp) CandidateRunning(intf string) (map[string]string, error) {
+	candidate, running, managed := intfmgr.candidateRunning(intf)
+	if !managed {
+		err := mgmterror.NewDataMissingError()
+		err.Message = "Interface not managed by ifmgrd"
+		return nil, err
+	}
+	out := make(map[string]string, 2)
+	var err error
+	if out["candidate"], err = d.marshalConfig(candidate, false); err != nil {
+		return nil, err
+	}
+	if out["running"], err = d.marshalConfig(running, false); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Write each managed interface's running configuration to
+// <dumpdir>/<interface>-<time>.json, returning the files written.
+// Interfaces whose names would write elsewhere are not dumped.
+func (d *Disp) DumpConfig() ([]string, error) {
+	dir := intfmgr.settings().DumpDir
+	if dir == "" {
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = "No dump directory is configured"
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	out := make([]string, 0)
+	for _, intf := range intfmgr.managedInterfaces() {
+		if strings.Contains(intf, "/") || strings.Contains(intf, "..") {
+			fmt.Fprintln(os.Stderr, "Not dumping", intf,
+				"- not usable as a file name")
+			continue
+		}
+		cfg, err := d.Running(intf)
+		if err != nil {
+			// unregistered since we listed the interfaces
+			continue
+		}
+		file := filepath.Join(dir, intf+"-"+stamp+".json")
+		if err := ioutil.WriteFile(file, []byte(cfg), 0600); err != nil {
+			return nil, err
+		}
+		out = append(out, file)
+	}
+	return out, nil
 }
 
 func (d *Disp) Exists(db rpc.DB, sid string, path string) (bool, error) {
@@ -114,7 +722,10 @@ func (d *Disp) Exists(db rpc.DB, sid string, path string) (bool, error) {
 		return false, err
 	}
 
-	ut := d.getTree(db, sid)
+	ut, err := d.getTree(db, sid)
+	if err != nil {
+		return false, err
+	}
 	exists := ut.Exists(nil, ps)
 	return exists == nil, nil
 }
@@ -124,7 +735,10 @@ func (d *Disp) NodeGetStatus(
 	sid string,
 	path string,
 ) (rpc.NodeStatus, error) {
-	session := sessionmgr.Get(sid)
+	session, err := getSession(sid)
+	if err != nil {
+		return rpc.UNCHANGED, err
+	}
 	diffTree := diff.NewNode(session.candidate,
 		session.running, SchemaTree.Load(), nil)
 
@@ -170,7 +784,11 @@ func (d *Disp) NodeIsDefault(
 	sid string,
 	path string,
 ) (bool, error) {
-	return d.getTree(db, sid).IsDefault(nil, pathutil.Makepath(path))
+	ut, err := d.getTree(db, sid)
+	if err != nil {
+		return false, err
+	}
+	return ut.IsDefault(nil, pathutil.Makepath(path))
 }
 
 func (d *Disp) TreeGet(
@@ -179,13 +797,26 @@ func (d *Disp) TreeGet(
 	flags map[string]interface{},
 ) (string, error) {
 	ps := pathutil.Makepath(path)
-	ut, _ := d.getTree(db, sid).Descendant(nil, ps)
+	tree, err := d.getTree(db, sid)
+	if err != nil {
+		return "", err
+	}
+	ut, _ := tree.Descendant(nil, ps)
 	if ut == nil {
 		err := mgmterror.NewUnknownElementApplicationError(ps[len(ps)-1])
 		err.Path = pathutil.Pathstr(ps[:len(ps)-1])
 		return "", err
 	}
 
+	return ut.Marshal("data", encoding, treeOptions(flags, d.secrets)...)
+}
+
+// treeOptions returns the marshalling options for a caller's flags.
+// Secrets are hidden, whatever the caller asks, unless showSecrets.
+func treeOptions(
+	flags map[string]interface{},
+	showSecrets bool,
+) []union.UnionOption {
 	var options []union.UnionOption
 	if f, exists := flags["Defaults"]; exists {
 		defaults, _ := f.(bool)
@@ -197,10 +828,10 @@ func (d *Disp) TreeGet(
 	if f, exists := flags["Secrets"]; exists {
 		secrets, _ = f.(bool)
 	}
-	if !secrets {
+	if !secrets || !showSecrets {
 		options = append(options, union.HideSecrets)
 	}
-	return ut.Marshal("data", encoding, options...)
+	return options
 }
 
 func (d *Disp) SessionExists(sid string) (bool, error) {
@@ -208,10 +839,34 @@ func (d *Disp) SessionExists(sid string) (bool, error) {
 	return sess != nil, nil
 }
 
+// List the open sessions, giving the interface whose commit each was
+// created for, to find sessions that outlive their commit.
+func (d *Disp) ListSessions() (map[string]string, error) {
+	return sessionmgr.interfaces(), nil
+}
+
 //Pretend to be configd, proxy safe requests as needed
 func (d *Disp) NodeGetType(sid string, path string) (rpc.NodeType, error) {
 	return d.client.NodeGetType(path)
 }
+
+// Fetch configd's view of the configuration without needing a session.
+// configd authorizes the request as ifmgrd, not the caller, so it is
+// limited to callers allowed to see secrets.
+func (d *Disp) ConfigdTreeGet(db rpc.DB, path, encoding string) (string, error) {
+	if !d.secrets {
+		err := mgmterror.NewAccessDeniedApplicationError()
+		err.Message = "Reading configd configuration through ifmgrd " +
+			"requires membership of the secrets group"
+		return "", err
+	}
+	if d.client == nil {
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = "Not connected to configd"
+		return "", err
+	}
+	return d.client.TreeGet(db, path, encoding)
+}
 func (d *Disp) TmplGet(path string) (map[string]string, error) {
 	return d.client.TmplGet(path)
 }
@@ -0,0 +1,85 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danos/configd/rpc"
+	"github.com/danos/utils/pathutil"
+)
+
+func TestInterfacesPathAcceptsInterfaceConfig(t *testing.T) {
+	for _, path := range []string{
+		"/interfaces",
+		"/interfaces/dataplane/dp0s3/mtu",
+	} {
+		if err := interfacesPath(pathutil.Makepath(path)); err != nil {
+			t.Errorf("%s rejected: %s", path, err)
+		}
+	}
+}
+
+func TestRunningExistsRejectsOtherConfig(t *testing.T) {
+	for _, path := range []string{
+		"/",
+		"/system/host-name",
+		"/protocols/interfaces",
+	} {
+		_, err := (&Disp{}).RunningExists("dp0s3", path)
+		if err == nil || !strings.Contains(err.Error(), "/interfaces") {
+			t.Errorf("%s gave error %v, expected rejection", path, err)
+		}
+	}
+}
+
+func TestDiffJSONRejectsUnmanaged(t *testing.T) {
+	_, err := (&Disp{}).DiffJSON("tst0s99")
+	if err == nil || !strings.Contains(err.Error(), "not managed") {
+		t.Fatalf("Unmanaged interface gave error %v", err)
+	}
+}
+
+func TestInterfaceStateReportsState(t *testing.T) {
+	intfmgr.Register("tst0s14")
+	defer testUnregister(t, intfmgr, "tst0s14")
+	state, err := (&Disp{}).InterfaceState("tst0s14")
+	if err != nil || state != unplugged.String() {
+		t.Fatalf("State %q, error %v, expected %s",
+			state, err, unplugged)
+	}
+}
+
+func TestDumpConfigStaysInDumpDir(t *testing.T) {
+	orig := intfmgr.settings()
+	defer intfmgr.configure(orig)
+	intfmgr.configure(&Config{})
+	if _, err := (&Disp{}).DumpConfig(); err == nil {
+		t.Fatal("Dumped without a dump directory")
+	}
+
+	dir := t.TempDir()
+	intfmgr.configure(&Config{DumpDir: dir})
+	intfmgr.Register("../tst0s15")
+	defer testUnregister(t, intfmgr, "../tst0s15")
+	files, err := (&Disp{}).DumpConfig()
+	if err != nil || len(files) != 0 {
+		t.Fatalf("Dumped %v, error %v, for an unusable name", files, err)
+	}
+	outside, _ := filepath.Glob(filepath.Join(dir, "..", "tst0s15-*"))
+	if len(outside) != 0 {
+		t.Fatalf("Dumped outside %s: %v", dir, outside)
+	}
+}
+
+func TestConfigdTreeGetWithoutConfigd(t *testing.T) {
+	_, err := (&Disp{secrets: true}).ConfigdTreeGet(rpc.RUNNING, "", "json")
+	if err == nil || !strings.Contains(err.Error(), "Not connected") {
+		t.Fatalf("Unconnected read gave error %v", err)
+	}
+}
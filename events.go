@@ -0,0 +1,196 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventQueueLen = 256
+
+// Event is a line of the event socket's newline delimited JSON stream.
+// Type is the name of a notification, with the notification as Data,
+// or one of "transition" or "apply-result". A reader's own "filter"
+// and "error" events acknowledge or reject the filters it sends.
+type Event struct {
+	Time      time.Time   `json:"time"`
+	Type      string      `json:"type"`
+	Interface string      `json:"interface,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+type Transition struct {
+	Event string `json:"event"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type ApplyResult struct {
+	Error       string `json:"error,omitempty"`
+	Transaction string `json:"transaction,omitempty"`
+}
+
+type eventReader struct {
+	queue chan []byte
+	// glob matched against the interface of each event, guarded by
+	// the broker's lock; empty for every event
+	filter string
+}
+
+// wants reports whether the reader's filter passes events for intf.
+// Events not concerning an interface always pass.
+func (r *eventReader) wants(intf string) bool {
+	if r.filter == "" || intf == "" {
+		return true
+	}
+	matched, _ := path.Match(r.filter, intf)
+	return matched
+}
+
+// eventBroker copies each event to every connected reader. A reader
+// that falls behind misses events rather than holding up the daemon.
+type eventBroker struct {
+	sync.Mutex
+	readers map[*eventReader]struct{}
+}
+
+var events = newEventBroker()
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{readers: make(map[*eventReader]struct{})}
+}
+
+func (b *eventBroker) subscribe() *eventReader {
+	r := &eventReader{queue: make(chan []byte, eventQueueLen)}
+	b.Lock()
+	defer b.Unlock()
+	b.readers[r] = struct{}{}
+	return r
+}
+
+func (b *eventBroker) unsubscribe(r *eventReader) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.readers, r)
+}
+
+// setFilter limits the reader to events for interfaces matching the
+// glob pattern, or passes every event if the pattern is empty.
+func (b *eventBroker) setFilter(r *eventReader, pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	r.filter = pattern
+	return nil
+}
+
+// reply queues an event for a single reader.
+func (r *eventReader) reply(typ string, data interface{}) {
+	line, err := json.Marshal(&Event{
+		Time: time.Now(),
+		Type: typ,
+		Data: data,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to encode", typ, "event:", err)
+		return
+	}
+	select {
+	case r.queue <- append(line, '\n'):
+	default:
+		metrics.Inc("events-dropped")
+	}
+}
+
+func (b *eventBroker) Publish(typ, intf string, data interface{}) {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.readers) == 0 {
+		return
+	}
+	line, err := json.Marshal(&Event{
+		Time:      time.Now(),
+		Type:      typ,
+		Interface: intf,
+		Data:      data,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to encode", typ, "event:", err)
+		return
+	}
+	line = append(line, '\n')
+	for r := range b.readers {
+		if !r.wants(intf) {
+			continue
+		}
+		select {
+		case r.queue <- line:
+		default:
+			metrics.Inc("events-dropped")
+		}
+	}
+}
+
+// ServeEvents streams events to each client connecting to the
+// listener until the listener is closed.
+func ServeEvents(l *net.UnixListener) error {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go streamEvents(conn)
+	}
+}
+
+func streamEvents(conn *net.UnixConn) {
+	r := events.subscribe()
+	defer events.unsubscribe(r)
+	defer conn.Close()
+
+	// Each line a reader sends is a glob replacing its filter on the
+	// interfaces it is sent events for; an empty line removes the
+	// filter. Reads fail once the reader hangs up.
+	hangup := make(chan struct{})
+	go func() {
+		defer close(hangup)
+		lines := bufio.NewScanner(conn)
+		for lines.Scan() {
+			pattern := strings.TrimSpace(lines.Text())
+			if err := events.setFilter(r, pattern); err != nil {
+				r.reply("error", "Invalid filter "+pattern+": "+
+					err.Error())
+				continue
+			}
+			r.reply("filter", pattern)
+		}
+	}()
+
+	for {
+		select {
+		case line := <-r.queue:
+			if _, err := conn.Write(line); err != nil {
+				return
+			}
+		case <-hangup:
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Wait for the broker to have n readers
+func testWaitReaders(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events.Lock()
+		readers := len(events.readers)
+		events.Unlock()
+		if readers == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Event readers %d, expected %d", readers, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEventsReachEveryReader(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "events.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	go ServeEvents(l)
+
+	readers := make([]*bufio.Reader, 2)
+	for i := range readers {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		defer conn.Close()
+		readers[i] = bufio.NewReader(conn)
+	}
+	testWaitReaders(t, len(readers))
+
+	events.Publish("transition", "tstev0",
+		&Transition{Event: "Plug", From: "Unplugged", To: "Applying"})
+
+	for i, r := range readers {
+		var ev struct {
+			Type      string     `json:"type"`
+			Interface string     `json:"interface"`
+			Data      Transition `json:"data"`
+		}
+		// skip events from machines left by other tests
+		for ev.Interface != "tstev0" {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				t.Fatalf("Reader %d failed: %s", i, err)
+			}
+			if err := json.Unmarshal(line, &ev); err != nil {
+				t.Fatalf("Reader %d got invalid event %q: %s", i, line, err)
+			}
+		}
+		if ev.Type != "transition" || ev.Data.To != "Applying" {
+			t.Fatalf("Reader %d got unexpected event %+v", i, ev)
+		}
+	}
+}
+
+func TestEventsFilteredByInterface(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "events.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	go ServeEvents(l)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	testWaitReaders(t, 1)
+
+	var ev struct {
+		Type      string      `json:"type"`
+		Interface string      `json:"interface"`
+		Data      interface{} `json:"data"`
+	}
+	next := func() {
+		ev.Type, ev.Interface, ev.Data = "", "", nil
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("Reader failed: %s", err)
+		}
+		if err := json.Unmarshal(line, &ev); err != nil {
+			t.Fatalf("Invalid event %q: %s", line, err)
+		}
+	}
+
+	conn.Write([]byte("[\n"))
+	for ev.Type != "error" {
+		next()
+	}
+	conn.Write([]byte("tstfl*\n"))
+	for ev.Type != "filter" {
+		next()
+	}
+	if ev.Data != "tstfl*" {
+		t.Fatalf("Filter acknowledged as %v", ev.Data)
+	}
+
+	events.Publish("transition", "tstev1", &Transition{To: "Applying"})
+	events.Publish("transition", "tstfl0", &Transition{To: "Plugged"})
+	next()
+	if ev.Interface != "tstfl0" {
+		t.Fatalf("Filtered reader got event for %q", ev.Interface)
+	}
+}
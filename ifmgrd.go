@@ -8,13 +8,34 @@
 package ifmgrd
 
 import (
+	"path"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/danos/config/schema"
 )
 
+// atomicSchemaNode holds the schema in use by the daemon.
+//
+// Until the daemon's schema has been stored the bootstrap tree is
+// empty and the schema is not ready; RPCs are rejected rather than
+// served against it.
+//
+// Each RPC pins the schema for its duration, so it sees one schema
+// throughout however many times it loads it. Storing a new schema
+// waits for pinned RPCs to complete, and RPCs arriving while a store
+// is waiting are rejected rather than queued behind it.
 type atomicSchemaNode struct {
 	atomic.Value
+	ready int32
+	// milliseconds taken to compile the stored schema
+	compileMs int64
+
+	// swap is held shared by RPCs and exclusively by Store; swapping
+	// is set while Store waits for it
+	swap     sync.RWMutex
+	swapping int32
 }
 
 // atomic.Values need to be consistently store a concrete type.
@@ -27,12 +48,40 @@ type nodeWrapper struct {
 func newAtomicSchemaNode() *atomicSchemaNode {
 	a := &atomicSchemaNode{}
 	tree, _ := schema.NewTree(nil)
-	a.Store(tree)
+	a.Value.Store(&nodeWrapper{tree})
 	return a
 }
 
+// Store replaces the schema once no RPC has it pinned.
 func (t *atomicSchemaNode) Store(n schema.Node) {
+	atomic.AddInt32(&t.swapping, 1)
+	t.swap.Lock()
 	t.Value.Store(&nodeWrapper{n})
+	atomic.StoreInt32(&t.ready, 1)
+	t.swap.Unlock()
+	atomic.AddInt32(&t.swapping, -1)
+}
+
+// pin keeps the schema from being replaced until the returned function
+// is called. It fails if a new schema is waiting to be stored.
+func (t *atomicSchemaNode) pin() (func(), bool) {
+	if atomic.LoadInt32(&t.swapping) != 0 {
+		return nil, false
+	}
+	t.swap.RLock()
+	return t.swap.RUnlock, true
+}
+
+// StoreCompiled stores a newly compiled schema, recording how long it
+// took to compile.
+func (t *atomicSchemaNode) StoreCompiled(n schema.Node, took time.Duration) {
+	atomic.StoreInt64(&t.compileMs, int64(took/time.Millisecond))
+	t.Store(n)
+}
+
+// Ready reports whether the daemon's schema has been stored.
+func (t *atomicSchemaNode) Ready() bool {
+	return atomic.LoadInt32(&t.ready) != 0
 }
 
 func (t *atomicSchemaNode) Load() schema.Node {
@@ -46,13 +95,224 @@ var SchemaTree *atomicSchemaNode
 
 func init() {
 	sessionmgr = NewSessionMap()
+	sessionmgr.registerMetrics()
 	intfmgr = NewIntfManager()
+	intfmgr.registerMetrics()
+	metrics.Gauge("schema-compile-ms", func() int64 {
+		return atomic.LoadInt64(&SchemaTree.compileMs)
+	})
 	SchemaTree = newAtomicSchemaNode()
 }
 
 type Config struct {
-	Yangdir       string
-	Socket        string
-	Capabilities  string
-	ConfigdSocket string
+	// Directory the schema was compiled from; FallbackYangdir when
+	// the YANG in the primary directory was unusable.
+	Yangdir string
+	// Directory to compile the schema from when that in the primary
+	// directory fails or defines no interfaces. Empty disables it.
+	FallbackYangdir string
+	Socket          string
+	Capabilities    string
+	ConfigdSocket   string
+	// An interface with configuration waiting to be applied for longer
+	// than this is reported as stalled. Zero disables the check.
+	ApplyLagThreshold time.Duration
+	// Maximum number of interfaces that may be registered. Zero means
+	// unlimited.
+	MaxInterfaces int
+	// Maximum number of configuration sessions clients may have open
+	// at once; the sessions of ifmgrd's own commits don't count. Zero
+	// means unlimited.
+	MaxSessions int
+	// Bytes of the output of each commit's actions kept, the rest
+	// truncated. Zero means unlimited.
+	MaxCommitOutput int
+	// A commit still running after this long is abandoned and the
+	// interface's state machine recovers. Zero disables the watchdog.
+	ApplyTimeout time.Duration
+	// Apply calls arriving within this long of the first are
+	// coalesced and only the last configuration is dispatched. Zero
+	// dispatches every Apply immediately.
+	ApplyDebounce time.Duration
+	// Configuration received while an interface's commit is running
+	// is committed no sooner than this long after that commit started,
+	// coalescing the changes received meanwhile. Zero commits as soon
+	// as the previous commit is done.
+	MinCommitInterval time.Duration
+	// Start managing any interface that appears in an applied
+	// configuration, rather than waiting for it to be registered.
+	AutoRegister bool
+	// Reject an Apply whose interfaces configuration contains nodes
+	// unknown to the schema, rather than leaving them to fail, or be
+	// ignored, when committed.
+	StrictApply bool
+	// Limit notifications emitted to this many per second, in bursts
+	// of up to NotifyBurst. Zero is unlimited.
+	NotifyRate  float64
+	NotifyBurst int
+	// While notifications are limited, combine waiting
+	// configuration-updated and interface-state notifications into
+	// a single batch-update.
+	NotifyBatch bool
+	// Check whether each managed interface is present this often,
+	// plugging or unplugging it to match, for systems where nothing
+	// sends plug and unplug events. Zero disables polling.
+	PlugPollInterval time.Duration
+	// Report an interface that has not been plugged this long after
+	// it was registered as waiting for hardware. Zero disables the
+	// report.
+	NeverPluggedTimeout time.Duration
+	// Paths of configuration nodes whose values are never logged or
+	// reported, even to callers allowed to see secrets, in addition
+	// to secret nodes. Elements may be "*" to match any list key, as
+	// in /interfaces/dataplane/*/description.
+	RedactPaths []string
+	// File recording the registered interfaces, so that they are
+	// registered again when the daemon restarts. Registrations are
+	// not kept if empty.
+	RegistrationFile string
+	// Directory DumpConfig writes interfaces' running configuration
+	// to. Dumps are refused if empty.
+	DumpDir string
+	// Glob patterns of the interfaces the daemon may manage; others
+	// are refused by register and skipped by auto-register. Any
+	// interface may be managed when empty.
+	ManageAllowlist []string
+	// Track configuration and interface state as usual but never run
+	// commit actions, logging those that would have run instead. The
+	// running configuration and notifications reflect what would have
+	// been applied.
+	Observe bool
+	// Requests from a single connection handled at once, so a client
+	// may pipeline independent calls. Responses to concurrent requests
+	// are sent as each completes and matched to requests by Id. Zero
+	// or one handles each connection's requests in turn.
+	ConnConcurrency int
+	// Wait after a temporary error accepting a connection, such as
+	// running out of file descriptors, doubling with each consecutive
+	// error up to AcceptBackoffMax. Zero uses 10ms and 1s.
+	AcceptBackoff    time.Duration
+	AcceptBackoffMax time.Duration
+	// Callers in one of these groups, or running as root, may call any
+	// method Permissions allows. Everyone else is limited to PermRead,
+	// the DefaultUntrustedMethods. When empty all callers are trusted.
+	TrustedGroups []string
+	// Show secrets to every caller, skipping the lookup of the
+	// caller's groups when all callers are trusted. Anyone able to
+	// connect to the socket can then read passwords and keys from
+	// the configuration; only use on single-user systems.
+	AlwaysShowSecrets bool
+	// Run around every interface commit, no hooks if nil.
+	CommitHooks CommitHooks
+	// Maps each caller's credentials to the operations it may
+	// perform, before callers outside TrustedGroups are limited to
+	// reading. If nil every caller may do everything and members of
+	// the secrets group see secrets.
+	Permissions PermissionMapper
 }
+
+// EffectiveConfig is the configuration the daemon is running with, as
+// reported by the DaemonConfig RPC. Durations are in time.Duration
+// string form. Commit hooks and the permission mapper are code rather
+// than configuration and are not reported.
+type EffectiveConfig struct {
+	Yangdir             string   `json:"yangdir"`
+	FallbackYangdir     string   `json:"fallback-yangdir"`
+	Socket              string   `json:"socket"`
+	Capabilities        string   `json:"capabilities"`
+	ConfigdSocket       string   `json:"configd-socket"`
+	ApplyLagThreshold   string   `json:"apply-lag-threshold"`
+	MaxInterfaces       int      `json:"max-interfaces"`
+	MaxSessions         int      `json:"max-sessions"`
+	MaxCommitOutput     int      `json:"max-commit-output"`
+	ApplyTimeout        string   `json:"apply-timeout"`
+	ApplyDebounce       string   `json:"apply-debounce"`
+	MinCommitInterval   string   `json:"min-commit-interval"`
+	AutoRegister        bool     `json:"auto-register"`
+	StrictApply         bool     `json:"strict-apply"`
+	NotifyRate          float64  `json:"notify-rate"`
+	NotifyBurst         int      `json:"notify-burst"`
+	NotifyBatch         bool     `json:"notify-batch"`
+	PlugPollInterval    string   `json:"plug-poll-interval"`
+	NeverPluggedTimeout string   `json:"never-plugged-timeout"`
+	RedactPaths         []string `json:"redact-paths"`
+	RegistrationFile    string   `json:"registration-file"`
+	DumpDir             string   `json:"dump-dir"`
+	ManageAllowlist     []string `json:"manage-allowlist"`
+	Observe             bool     `json:"observe"`
+	ConnConcurrency     int      `json:"conn-concurrency"`
+	AcceptBackoff       string   `json:"accept-backoff"`
+	AcceptBackoffMax    string   `json:"accept-backoff-max"`
+	TrustedGroups       []string `json:"trusted-groups"`
+	UntrustedMethods    []string `json:"untrusted-methods"`
+	AlwaysShowSecrets   bool     `json:"show-secrets"`
+}
+
+// manageAllowed reports whether the interface matches ManageAllowlist.
+func (c *Config) manageAllowed(intfName string) bool {
+	if len(c.ManageAllowlist) == 0 {
+		return true
+	}
+	for _, pattern := range c.ManageAllowlist {
+		if matched, _ := path.Match(pattern, intfName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptBackoffs returns the first and longest waits after temporary
+// accept errors, with defaults applied.
+func (c *Config) acceptBackoffs() (base, max time.Duration) {
+	base, max = c.AcceptBackoff, c.AcceptBackoffMax
+	if base <= 0 {
+		base = 10 * time.Millisecond
+	}
+	if max <= 0 {
+		max = time.Second
+	}
+	if max < base {
+		max = base
+	}
+	return base, max
+}
+
+func (c *Config) effective() *EffectiveConfig {
+	acceptBackoff, acceptBackoffMax := c.acceptBackoffs()
+	return &EffectiveConfig{
+		Yangdir:             c.Yangdir,
+		FallbackYangdir:     c.FallbackYangdir,
+		Socket:              c.Socket,
+		Capabilities:        c.Capabilities,
+		ConfigdSocket:       c.ConfigdSocket,
+		ApplyLagThreshold:   c.ApplyLagThreshold.String(),
+		MaxInterfaces:       c.MaxInterfaces,
+		MaxSessions:         c.MaxSessions,
+		MaxCommitOutput:     c.MaxCommitOutput,
+		ApplyTimeout:        c.ApplyTimeout.String(),
+		ApplyDebounce:       c.ApplyDebounce.String(),
+		MinCommitInterval:   c.MinCommitInterval.String(),
+		AutoRegister:        c.AutoRegister,
+		StrictApply:         c.StrictApply,
+		NotifyRate:          c.NotifyRate,
+		NotifyBurst:         c.NotifyBurst,
+		NotifyBatch:         c.NotifyBatch,
+		PlugPollInterval:    c.PlugPollInterval.String(),
+		NeverPluggedTimeout: c.NeverPluggedTimeout.String(),
+		RedactPaths:         c.RedactPaths,
+		RegistrationFile:    c.RegistrationFile,
+		DumpDir:             c.DumpDir,
+		ManageAllowlist:     c.ManageAllowlist,
+		Observe:             c.Observe,
+		ConnConcurrency:     c.ConnConcurrency,
+		AcceptBackoff:       acceptBackoff.String(),
+		AcceptBackoffMax:    acceptBackoffMax.String(),
+		TrustedGroups:       c.TrustedGroups,
+		UntrustedMethods:    DefaultUntrustedMethods,
+		AlwaysShowSecrets:   c.AlwaysShowSecrets,
+	}
+}
+
+// DefaultUntrustedMethods are the read-only methods available to
+// callers that are not trusted, those needing only PermRead.
+var DefaultUntrustedMethods = readMethods()
@@ -0,0 +1,73 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danos/config/schema"
+)
+
+func TestSchemaReadyOnceStored(t *testing.T) {
+	tree := newAtomicSchemaNode()
+	if tree.Ready() {
+		t.Fatal("Bootstrap schema reported ready")
+	}
+	tree.StoreCompiled(tree.Load(), 1500*time.Millisecond)
+	if !tree.Ready() {
+		t.Fatal("Stored schema not reported ready")
+	}
+	if tree.compileMs != 1500 {
+		t.Fatalf("Compile time recorded as %dms", tree.compileMs)
+	}
+}
+
+func TestEffectiveConfigDefaults(t *testing.T) {
+	eff := (&Config{ApplyTimeout: 10 * time.Minute}).effective()
+	if eff.ApplyTimeout != "10m0s" {
+		t.Fatalf("Apply timeout reported as %q", eff.ApplyTimeout)
+	}
+	if len(eff.UntrustedMethods) != len(DefaultUntrustedMethods) {
+		t.Fatalf("Untrusted methods %v, expected the defaults",
+			eff.UntrustedMethods)
+	}
+}
+
+func TestSchemaStoreWaitsForPinnedRPCs(t *testing.T) {
+	tree := newAtomicSchemaNode()
+	old := tree.Load()
+	unpin, ok := tree.pin()
+	if !ok {
+		t.Fatal("Schema could not be pinned")
+	}
+	next, _ := schema.NewTree(nil)
+	stored := make(chan struct{})
+	go func() {
+		tree.Store(next)
+		close(stored)
+	}()
+	for atomic.LoadInt32(&tree.swapping) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if tree.Load() != old {
+		t.Fatal("Schema replaced while pinned")
+	}
+	if _, ok := tree.pin(); ok {
+		t.Fatal("Schema pinned while a store was waiting")
+	}
+	unpin()
+	<-stored
+	if tree.Load() != next {
+		t.Fatal("Schema not replaced once unpinned")
+	}
+	unpin, ok = tree.pin()
+	if !ok {
+		t.Fatal("Schema could not be pinned after the store")
+	}
+	unpin()
+}
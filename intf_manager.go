@@ -9,10 +9,17 @@
 package ifmgrd
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/danos/config/data"
+	"github.com/danos/mgmterror"
 )
 
 /*
@@ -33,32 +40,225 @@ func listConfigInterfaces(config *data.Node) []string {
 
 type IntfManager struct {
 	sync.Mutex
-	config     *data.Node
+	config *data.Node
+	// config, readable by machines' commits without the lock
+	current    *data.AtomicNode
 	interfaces map[string]*IntfMachine
+	// daemon tunables, set once at startup
+	cfg *Config
+	// transaction id supplied with config
+	txn string
+	// numbers the messages dispatched to machines
+	dispatchSeq uint64
+	// configuration waiting for the debounce window to expire
+	pending    *data.Node
+	pendingTxn string
+	debounce   *time.Timer
+	// interfaces decommissioned and not registered since, which
+	// are not registered automatically
+	decommissioned map[string]struct{}
+	// interfaces whose configuration is held back until their
+	// apply-after dependency converges, and the timer checking them
+	deferred     map[string]struct{}
+	deferredPoll *time.Timer
+	// interfaces whose configuration the dispatch in progress
+	// changes, nil outside dispatch
+	dispatching map[string]struct{}
+	// apply generation of each interface, counting the changes to
+	// its configuration
+	generations map[string]int
 }
 
 func NewIntfManager() *IntfManager {
 	return &IntfManager{
-		interfaces: make(map[string]*IntfMachine),
+		current:        data.NewAtomicNode(nil),
+		interfaces:     make(map[string]*IntfMachine),
+		cfg:            &Config{},
+		decommissioned: make(map[string]struct{}),
+		deferred:       make(map[string]struct{}),
+		generations:    make(map[string]int),
 	}
 }
 
-func (mgr *IntfManager) Register(intfName string) {
+func (mgr *IntfManager) configure(cfg *Config) {
 	mgr.Lock()
 	defer mgr.Unlock()
+	mgr.cfg = cfg
+}
+
+func (mgr *IntfManager) settings() *Config {
+	mgr.Lock()
+	defer mgr.Unlock()
+	return mgr.cfg
+}
+
+func (mgr *IntfManager) registerMetrics() {
+	metrics.Gauge("apply-lag-max-ms", func() int64 {
+		lag, _ := mgr.maxApplyLag()
+		return int64(lag / time.Millisecond)
+	})
+	metrics.Gauge("apply-lag-stalled", func() int64 {
+		return int64(len(mgr.stalledApplies()))
+	})
+	metrics.Gauge("message-queue-depth-max", func() int64 {
+		var max int
+		for _, depth := range mgr.queueDepths() {
+			if depth > max {
+				max = depth
+			}
+		}
+		return int64(max)
+	})
+}
+
+func (mgr *IntfManager) Register(intfName string) error {
+	mgr.Lock()
+	defer mgr.Unlock()
+	if err := mgr.register(intfName); err != nil {
+		return err
+	}
+	delete(mgr.decommissioned, intfName)
+	mgr.saveRegistrations()
+	return nil
+}
+
+// saveRegistrations records the managed interfaces in the registration
+// file, if there is one, so they are managed again after a restart.
+// It must be called with the manager locked.
+func (mgr *IntfManager) saveRegistrations() {
+	path := mgr.cfg.RegistrationFile
+	if path == "" {
+		return
+	}
+	names := make([]string, 0, len(mgr.interfaces))
+	for name := range mgr.interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf strings.Builder
+	for _, name := range names {
+		buf.WriteString(name + "\n")
+	}
+	// replace the file whole so a crash can't leave it half written
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(buf.String()), 0644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to save registered interfaces:", err)
+	}
+}
+
+// LoadRegistrations registers the interfaces recorded in the
+// registration file. A missing file registers nothing.
+func (mgr *IntfManager) LoadRegistrations() error {
+	path := mgr.settings().RegistrationFile
+	if path == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range strings.Split(string(buf), "\n") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if err := mgr.Register(name); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to restore registration of",
+				name+":", err)
+		}
+	}
+	return nil
+}
 
+// register must be called with the manager locked
+func (mgr *IntfManager) register(intfName string) error {
 	_, registered := mgr.interfaces[intfName]
 	if registered {
-		return
+		return nil
 	}
-	intf := NewIntfMachine(intfName)
+	if !mgr.cfg.manageAllowed(intfName) {
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = fmt.Sprintf(
+			"Cannot manage %s: not in the manage allowlist", intfName)
+		return err
+	}
+	if mgr.cfg.MaxInterfaces > 0 &&
+		len(mgr.interfaces) >= mgr.cfg.MaxInterfaces {
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = fmt.Sprintf(
+			"Cannot manage %s: limit of %d managed interfaces reached",
+			intfName, mgr.cfg.MaxInterfaces)
+		return err
+	}
+	intf := newIntfMachine(intfName, mgr.cfg, mgr.current)
 	mgr.interfaces[intfName] = intf
 
-	intf.Apply(mgr.config)
-	_, err := net.InterfaceByName(intfName)
-	if err == nil {
-		intf.Plug()
+	// Until configuration is first applied there is nothing to stage
+	if mgr.config != nil && !mgr.deferApply(intfName) {
+		intf.ApplyTxn(mgr.config, mgr.txn)
 	}
+	if interfacePresent(intfName) {
+		intf.PlugReason("present when registered")
+	} else {
+		// Plug announces present interfaces; announce absent ones
+		// too so subscribers learn the starting state of every
+		// managed interface.
+		intf.notifyInterfaceState("unplugged", "")
+	}
+	return nil
+}
+
+// interfacePresent reports whether the interface exists on the system.
+// Tests replace it to fake interfaces coming and going.
+var interfacePresent = func(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// pollPlugged plugs managed interfaces present on the system that are
+// not plugged, and unplugs those that are plugged but absent.
+func (mgr *IntfManager) pollPlugged() {
+	mgr.Lock()
+	machs := make(map[string]*IntfMachine, len(mgr.interfaces))
+	for name, intf := range mgr.interfaces {
+		machs[name] = intf
+	}
+	mgr.Unlock()
+
+	for name, intf := range machs {
+		present := interfacePresent(name)
+		if present == intf.IsPlugged() {
+			continue
+		}
+		metrics.Inc("plug-poll-corrections")
+		if present {
+			fmt.Println("Poll found", name, "present, plugging")
+			intf.PlugReason("poll")
+		} else {
+			fmt.Println("Poll found", name, "absent, unplugging")
+			intf.UnplugReason("poll")
+		}
+	}
+}
+
+// PollPlugged checks whether each managed interface is present every
+// interval, plugging and unplugging it to match. A fallback for
+// systems where nothing sends plug and unplug events.
+func (mgr *IntfManager) PollPlugged(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			mgr.pollPlugged()
+		}
+	}()
 }
 
 func (mgr *IntfManager) Unregister(intfName string) {
@@ -71,58 +271,962 @@ func (mgr *IntfManager) Unregister(intfName string) {
 	}
 	delete(mgr.interfaces, intfName)
 	intf.Kill()
+	mgr.saveRegistrations()
 }
 
+// Decommission stops managing an interface once the configuration
+// applied to it has been removed, returning when it has. Unlike an
+// unregistered interface, a decommissioned interface is not registered
+// automatically when it appears in applied configuration; only an
+// explicit Register manages it again. Returns false if the interface
+// is not managed.
+func (mgr *IntfManager) Decommission(intfName string) bool {
+	mgr.Lock()
+	intf, managed := mgr.interfaces[intfName]
+	if !managed {
+		mgr.Unlock()
+		return false
+	}
+	delete(mgr.interfaces, intfName)
+	mgr.decommissioned[intfName] = struct{}{}
+	intf.Kill()
+	mgr.saveRegistrations()
+	mgr.Unlock()
+
+	// killing the machine removes the configuration it applied
+	<-intf.done
+	fmt.Println("Decommissioned interface", intfName)
+	return true
+}
+
+// treesEqual compares two configuration trees. Children are compared
+// in the order the tree returns them so a reordering is reported as a
+// change, erring on the side of applying.
+func treesEqual(a, b *data.Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Name() != b.Name() {
+		return false
+	}
+	achildren, bchildren := a.ChildNames(), b.ChildNames()
+	if len(achildren) != len(bchildren) {
+		return false
+	}
+	for i, name := range achildren {
+		if name != bchildren[i] {
+			return false
+		}
+		if !treesEqual(a.Child(name), b.Child(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func intfConfigChanged(name string, prev, config *data.Node) bool {
+	if prev == nil {
+		return true
+	}
+	return !treesEqual(findCommitRoot(name, prev), findCommitRoot(name, config))
+}
+
+// Apply dispatches the configuration to the managed interfaces. When a
+// debounce window is configured, configurations arriving within the
+// window of the first are coalesced and only the last is dispatched.
 func (mgr *IntfManager) Apply(config *data.Node) {
+	mgr.ApplyTxn(config, "")
+}
+
+// ApplyTxn applies configuration identified by the caller's
+// transaction id, so that its application can be traced.
+func (mgr *IntfManager) ApplyTxn(config *data.Node, txn string) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	mgr.applyTxn(config, txn)
+}
+
+// ApplyInterface applies the configuration of a single interface,
+// taken from config, leaving that of every other interface as last
+// applied. It returns false if config has no configuration for the
+// interface.
+func (mgr *IntfManager) ApplyInterface(name string, config *data.Node) bool {
+	update := findCommitRoot(name, config)
+	if update == nil {
+		return false
+	}
+	mgr.Lock()
+	defer mgr.Unlock()
+	mgr.applyInterface(name, update)
+	return true
+}
+
+// ApplyInterfaceCAS applies an interface's configuration as
+// ApplyInterface does, but only if the interface's apply generation is
+// still generation, so that a caller that read the generation does not
+// overwrite another's update. It returns whether the configuration was
+// applied, and false for found if config has no configuration for the
+// interface.
+func (mgr *IntfManager) ApplyInterfaceCAS(
+	name string,
+	generation int,
+	config *data.Node,
+) (applied, found bool) {
+	update := findCommitRoot(name, config)
+	if update == nil {
+		return false, false
+	}
+	mgr.Lock()
+	defer mgr.Unlock()
+	if mgr.generations[name] != generation {
+		metrics.Inc("applies-cas-rejected")
+		return false, true
+	}
+	mgr.applyInterface(name, update)
+	return true, true
+}
+
+// applyInterface must be called with the manager locked
+func (mgr *IntfManager) applyInterface(name string, update *data.Node) {
+	base := mgr.config
+	if mgr.pending != nil {
+		base = mgr.pending
+	}
+	mgr.applyTxn(withInterface(base, update, name), "")
+}
+
+// applyGeneration returns an interface's apply generation, which
+// increases each time its configuration changes. It is zero for an
+// interface that has never been configured.
+func (mgr *IntfManager) applyGeneration(name string) int {
 	mgr.Lock()
 	defer mgr.Unlock()
+	return mgr.generations[name]
+}
+
+// countGenerations advances the apply generation of each interface
+// whose configuration differs between prev and config.
+//
+// countGenerations must be called with the manager locked
+func (mgr *IntfManager) countGenerations(prev, config *data.Node) {
+	names := listConfigInterfaces(config)
+	if prev != nil {
+		names = append(names, listConfigInterfaces(prev)...)
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if intfConfigChanged(name, prev, config) {
+			mgr.generations[name]++
+		}
+	}
+}
+
+// ResetInterface removes the configuration applied to an interface,
+// leaving that of every other interface as last applied. The interface
+// stays managed and is configured again by the next configuration
+// applied with it. It returns false if the interface is not managed.
+func (mgr *IntfManager) ResetInterface(name string) bool {
+	mgr.Lock()
+	defer mgr.Unlock()
+	if _, managed := mgr.interfaces[name]; !managed {
+		return false
+	}
+	base := mgr.config
+	if mgr.pending != nil {
+		base = mgr.pending
+	}
+	if findCommitRoot(name, base) == nil {
+		// nothing to remove
+		return true
+	}
+	mgr.applyTxn(withInterface(base, nil, name), "")
+	return true
+}
+
+// withInterface returns a copy of config with the named interface's
+// configuration replaced by that in update, a tree rooted at
+// 'interfaces <type> <name>', or removed if update is nil. Unchanged
+// subtrees are shared with config.
+func withInterface(config, update *data.Node, name string) *data.Node {
+	var utyp *data.Node
+	if update != nil {
+		utyp = update.Child("interfaces").Children()[0]
+	}
+	out := data.New("root")
+	intfs := data.New("interfaces")
+	out.AddChild(intfs)
+	var types []*data.Node
+	if config != nil {
+		for _, ch := range config.Children() {
+			if ch.Name() != "interfaces" {
+				out.AddChild(ch)
+			} else {
+				types = ch.Children()
+			}
+		}
+	}
+	added := false
+	for _, typ := range types {
+		ntyp := data.New(typ.Name())
+		for _, intf := range typ.Children() {
+			if intf.Name() != name {
+				ntyp.AddChild(intf)
+			}
+		}
+		if utyp != nil && typ.Name() == utyp.Name() {
+			ntyp.AddChild(utyp.Child(name))
+			added = true
+		}
+		if len(ntyp.Children()) != 0 {
+			intfs.AddChild(ntyp)
+		}
+	}
+	if !added && utyp != nil {
+		intfs.AddChild(utyp)
+	}
+	return out
+}
+
+// applyTxn must be called with the manager locked
+func (mgr *IntfManager) applyTxn(config *data.Node, txn string) {
+	if mgr.pending != nil {
+		mgr.countGenerations(mgr.pending, config)
+	} else {
+		mgr.countGenerations(mgr.config, config)
+	}
+	if mgr.cfg.ApplyDebounce <= 0 {
+		mgr.txn = txn
+		mgr.dispatch(config)
+		return
+	}
+	mgr.pending = config
+	mgr.pendingTxn = txn
+	if mgr.debounce == nil {
+		mgr.debounce = time.AfterFunc(
+			mgr.cfg.ApplyDebounce, mgr.applyPending)
+	}
+}
+
+func (mgr *IntfManager) applyPending() {
+	mgr.Lock()
+	defer mgr.Unlock()
+	config := mgr.pending
+	mgr.txn = mgr.pendingTxn
+	mgr.pending = nil
+	mgr.pendingTxn = ""
+	mgr.debounce = nil
+	mgr.dispatch(config)
+}
+
+// dispatch sends the configuration to the machines of interfaces whose
+// configuration changed, and resets those whose configuration was
+// removed. Interfaces are visited in name order so that boots are
+// reproducible. It returns the interfaces applied and reset, in the
+// order they were sent.
+//
+// dispatch must be called with the manager locked
+func (mgr *IntfManager) dispatch(config *data.Node) (applied, removed []string) {
+	prev := mgr.config
 	mgr.config = config
-	//update managed interfaces
+	mgr.current.Store(config)
+	// Unregister removes a machine from the map, under the lock,
+	// before killing it, so only running machines are sent config.
+	//update managed interfaces whose configuration changed
 	configInterfaces := make(map[string]struct{})
-	for _, name := range listConfigInterfaces(config) {
+	names := listConfigInterfaces(config)
+	sort.Strings(names)
+	mgr.dispatching = make(map[string]struct{})
+	defer func() { mgr.dispatching = nil }()
+	for _, name := range names {
+		if intfConfigChanged(name, prev, config) {
+			mgr.dispatching[name] = struct{}{}
+		}
+	}
+	for _, name := range names {
+		configInterfaces[name] = struct{}{}
 		intf, managed := mgr.interfaces[name]
 		if !managed {
+			_, decommissioned := mgr.decommissioned[name]
+			if mgr.cfg.AutoRegister && !decommissioned {
+				// registering applies the current config
+				if err := mgr.register(name); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
 			continue
 		}
-		intf.Apply(config)
-		configInterfaces[name] = struct{}{}
+		if _, changed := mgr.dispatching[name]; !changed {
+			// don't wake the machine for a repeated configuration
+			metrics.Inc("applies-unchanged")
+			continue
+		}
+		if mgr.deferApply(name) {
+			continue
+		}
+		mgr.deliver(intf, &message{
+			typ:      apply,
+			data:     config,
+			received: time.Now(),
+			txn:      mgr.txn,
+		})
+		applied = append(applied, name)
 	}
 
-	//reset any interface that isn't in the config
-	for name, intf := range mgr.interfaces {
+	// Reset any interface that was removed from the config. Machines
+	// are sent the whole configuration; the interface is absent from
+	// it, so its candidate has no configuration for the interface
+	// and the commit removes all that was applied.
+	managed := make([]string, 0, len(mgr.interfaces))
+	for name := range mgr.interfaces {
+		managed = append(managed, name)
+	}
+	sort.Strings(managed)
+	for _, name := range managed {
 		if _, inConfig := configInterfaces[name]; inConfig {
 			continue
 		}
-		intf.Reset(config)
+		if prev != nil && findCommitRoot(name, prev) == nil {
+			continue
+		}
+		delete(mgr.deferred, name)
+		intf := mgr.interfaces[name]
+		mgr.deliver(intf, &message{
+			typ:      reset,
+			data:     config,
+			received: time.Now(),
+			txn:      mgr.txn,
+		})
+		// before the first configuration there was none to remove
+		if prev != nil {
+			intf.notifyConfigRemoved(mgr.txn)
+		}
+		removed = append(removed, name)
+	}
+	return applied, removed
+}
+
+// applyAfter returns the interface that must converge before the named
+// interface's configuration is applied, from the interface's
+// apply-after leaf, or "" if it has none.
+func applyAfter(name string, config *data.Node) string {
+	if config == nil || config.Child("interfaces") == nil {
+		return ""
+	}
+	for _, ifType := range config.Child("interfaces").Children() {
+		intf := ifType.Child(name)
+		if intf == nil {
+			continue
+		}
+		if leaf := intf.Child("apply-after"); leaf != nil {
+			if deps := leaf.ChildNames(); len(deps) == 1 {
+				return deps[0]
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// applyAfterPoll is how often interfaces held back by apply-after
+// check whether their dependency has converged.
+var applyAfterPoll = 100 * time.Millisecond
+
+// deferApply reports whether an interface's configuration must wait
+// for its apply-after dependency, recording it as deferred if so. A
+// dependency that is not managed is not waited for, nor is one that
+// depends on the interface in turn, which would wait forever. Whether
+// the dependency has converged is asked of its machine by
+// applyDeferred, without the manager locked, so the configuration is
+// applied at the next poll at the earliest.
+//
+// deferApply must be called with the manager locked
+func (mgr *IntfManager) deferApply(name string) bool {
+	if dep, _ := mgr.waitsForDependency(name); dep == nil {
+		delete(mgr.deferred, name)
+		return false
+	}
+	if _, deferred := mgr.deferred[name]; !deferred {
+		fmt.Println("Deferring configuration of", name, "until",
+			applyAfter(name, mgr.config), "has converged")
+		metrics.Inc("applies-deferred")
+		mgr.deferred[name] = struct{}{}
+	}
+	if mgr.deferredPoll == nil {
+		mgr.deferredPoll = time.AfterFunc(applyAfterPoll, mgr.applyDeferred)
 	}
+	return true
 }
 
-func (mgr *IntfManager) newSession(intfName string) string {
+// waitsForDependency returns the machine of an interface's apply-after
+// dependency, or nil if there is none to wait for, and whether the
+// dependency is itself still to be given its configuration.
+//
+// waitsForDependency must be called with the manager locked
+func (mgr *IntfManager) waitsForDependency(
+	name string,
+) (dep *IntfMachine, changing bool) {
+	depName := applyAfter(name, mgr.config)
+	seen := map[string]bool{name: true}
+	for d := depName; d != ""; d = applyAfter(d, mgr.config) {
+		if seen[d] {
+			fmt.Fprintln(os.Stderr, "Ignoring apply-after of", name,
+				"- dependency cycle through", d)
+			return nil, false
+		}
+		seen[d] = true
+	}
+	dep, managed := mgr.interfaces[depName]
+	if depName == "" || !managed {
+		return nil, false
+	}
+	if _, deferred := mgr.deferred[depName]; deferred {
+		return dep, true
+	}
+	if _, changing := mgr.dispatching[depName]; changing {
+		return dep, true
+	}
+	return dep, false
+}
+
+// applyDeferred applies the configuration of deferred interfaces whose
+// dependency has converged, checking again later for the rest. The
+// dependencies' machines are asked whether they have converged with
+// the manager unlocked.
+func (mgr *IntfManager) applyDeferred() {
+	mgr.Lock()
+	mgr.deferredPoll = nil
+	deps := make(map[string]*IntfMachine, len(mgr.deferred))
+	for name := range mgr.deferred {
+		if dep, changing := mgr.waitsForDependency(name); dep != nil &&
+			!changing {
+			deps[name] = dep
+		}
+	}
+	mgr.Unlock()
+
+	converged := make(map[string]bool, len(deps))
+	for name, dep := range deps {
+		converged[name] = dep.converged()
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+	names := make([]string, 0, len(mgr.deferred))
+	for name := range mgr.deferred {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		intf, managed := mgr.interfaces[name]
+		if !managed {
+			delete(mgr.deferred, name)
+			continue
+		}
+		// the dependency may have changed while unlocked
+		dep, changing := mgr.waitsForDependency(name)
+		if dep != nil &&
+			(changing || dep != deps[name] || !converged[name]) {
+			mgr.deferApply(name)
+			continue
+		}
+		delete(mgr.deferred, name)
+		mgr.deliver(intf, &message{
+			typ:      apply,
+			data:     mgr.config,
+			received: time.Now(),
+			txn:      mgr.txn,
+		})
+	}
+}
+
+// dispatchTimeout bounds how long dispatch waits for a machine to
+// receive its configuration while holding the manager lock.
+var dispatchTimeout = 5 * time.Second
+
+// deliver sends a dispatched message to a machine. A machine that does
+// not receive it within dispatchTimeout is logged and the message is
+// delivered in the background, so one wedged machine cannot hold the
+// manager lock. Until the background delivery completes later messages
+// queue behind it, replacing rather than adding to those waiting, so
+// a flood of configuration changes uses bounded memory. Messages are
+// numbered so that one delivered late is ignored if a later one has
+// already arrived.
+//
+// deliver must be called with the manager locked
+func (mgr *IntfManager) deliver(intf *IntfMachine, msg *message) {
+	mgr.dispatchSeq++
+	msg.seq = mgr.dispatchSeq
+	if intf.backlogged() {
+		intf.queueLatest(msg)
+		return
+	}
+	sent, timedOut := intf.sendWithin(msg, dispatchTimeout)
+	if sent {
+		return
+	}
+	if !timedOut {
+		fmt.Fprintln(os.Stderr, "Interface manager for", intf.ifname,
+			"has stopped, dropping", msg.typ)
+		metrics.Inc("messages-dropped")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Interface manager for", intf.ifname,
+		"did not receive", msg.typ, "within", dispatchTimeout,
+		"- delivering in the background")
+	metrics.Inc("dispatch-timeouts")
+	intf.queueLatest(msg)
+}
+
+// lastConfig returns the configuration last dispatched to the
+// machines, nil if none has been applied.
+func (mgr *IntfManager) lastConfig() *data.Node {
+	mgr.Lock()
+	defer mgr.Unlock()
+	return mgr.config
+}
+
+// running returns the interface's running configuration rooted at
+// 'interfaces <type> <name>'.
+func (mgr *IntfManager) running(intfName string) (*data.Node, bool) {
 	mgr.Lock()
 	defer mgr.Unlock()
 	intf, managed := mgr.interfaces[intfName]
 	if !managed {
-		return ""
+		return nil, false
 	}
-	return intf.newSession()
+	return findCommitRoot(intfName, intf.running.Load()), true
+}
+
+// candidateRunning returns an interface's candidate and running
+// configuration as held by its state machine at one instant.
+func (mgr *IntfManager) candidateRunning(
+	intfName string,
+) (candidate, running *data.Node, managed bool) {
+	mgr.Lock()
+	intf, managed := mgr.interfaces[intfName]
+	mgr.Unlock()
+	if !managed {
+		return nil, nil, false
+	}
+	if !intf.inspect(func(m *IntfMachine) {
+		candidate = m.candidate.Load()
+		running = m.running.Load()
+	}) {
+		return nil, nil, false
+	}
+	candidate = findCommitRoot(intfName, candidate)
+	if candidate == nil {
+		candidate = data.New("root")
+	}
+	running = findCommitRoot(intfName, running)
+	if running == nil {
+		running = data.New("root")
+	}
+	return candidate, running, true
+}
+
+// committer returns a committer for an interface's candidate and
+// running configuration, without starting a commit.
+func (mgr *IntfManager) committer(intfName string) (*Committer, bool) {
+	candidate, running, managed := mgr.candidateRunning(intfName)
+	if !managed {
+		return nil, false
+	}
+	return NewCommitter(candidate, running, SchemaTree.Load(), ""), true
 }
 
 func (mgr *IntfManager) Plug(intfName string) {
+	mgr.PlugReason(intfName, "")
+}
+
+// PlugReason plugs a managed interface, giving the reason or source of
+// the plug for the log and interface-state notification.
+func (mgr *IntfManager) PlugReason(intfName, reason string) {
 	mgr.Lock()
 	defer mgr.Unlock()
 	intf, managed := mgr.interfaces[intfName]
 	if !managed {
 		return
 	}
-	intf.Plug()
+	intf.PlugReason(reason)
 }
 
 func (mgr *IntfManager) Unplug(intfName string) {
+	mgr.UnplugReason(intfName, "")
+}
+
+// UnplugReason unplugs a managed interface, giving the reason or source
+// of the unplug for the log and interface-state notification.
+func (mgr *IntfManager) UnplugReason(intfName, reason string) {
 	mgr.Lock()
 	defer mgr.Unlock()
 	intf, managed := mgr.interfaces[intfName]
 	if !managed {
 		return
 	}
-	intf.Unplug()
+	intf.UnplugReason(reason)
+}
+
+// Reconcile re-applies the interface's running configuration, returning
+// false if the interface is not managed.
+func (mgr *IntfManager) Reconcile(intfName string) bool {
+	mgr.Lock()
+	defer mgr.Unlock()
+	intf, managed := mgr.interfaces[intfName]
+	if !managed {
+		return false
+	}
+	intf.Reconcile()
+	return true
+}
+
+// ClearError forgets the interface's last commit error, re-applying
+// its running configuration if reapply is set. Returns false if the
+// interface is not managed.
+func (mgr *IntfManager) ClearError(intfName string, reapply bool) bool {
+	mgr.Lock()
+	defer mgr.Unlock()
+	intf, managed := mgr.interfaces[intfName]
+	if !managed {
+		return false
+	}
+	if intf.clearError() {
+		fmt.Println("Cleared last error for interface", intfName)
+	}
+	if reapply {
+		intf.Reconcile()
+	}
+	return true
+}
+
+func (mgr *IntfManager) managedInterfaces() []string {
+	mgr.Lock()
+	defer mgr.Unlock()
+	out := make([]string, 0, len(mgr.interfaces))
+	for name := range mgr.interfaces {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// maxApplyLag returns the longest time any managed interface has had
+// configuration waiting to be applied, and that interface's name.
+func (mgr *IntfManager) maxApplyLag() (time.Duration, string) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	var max time.Duration
+	var maxIntf string
+	for name, intf := range mgr.interfaces {
+		lag := intf.ApplyLag()
+		if lag > max {
+			max, maxIntf = lag, name
+		}
+	}
+	return max, maxIntf
+}
+
+// queueDepths returns the number of messages waiting for each managed
+// interface's machine.
+func (mgr *IntfManager) queueDepths() map[string]int {
+	mgr.Lock()
+	defer mgr.Unlock()
+	out := make(map[string]int, len(mgr.interfaces))
+	for name, intf := range mgr.interfaces {
+		out[name] = intf.QueueDepth()
+	}
+	return out
+}
+
+// pendingInterfaces lists the managed interfaces that have not
+// converged: those with a commit in progress, or plugged with
+// configuration still to be applied. Unplugged interfaces have nothing
+// to apply until they are plugged so are converged.
+func (mgr *IntfManager) pendingInterfaces() []string {
+	out := make([]string, 0)
+	for name, intf := range mgr.machines() {
+		if !intf.converged() {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// machines returns a snapshot of the managed interfaces' machines, so
+// that they may be queried without holding the manager lock.
+func (mgr *IntfManager) machines() map[string]*IntfMachine {
+	mgr.Lock()
+	defer mgr.Unlock()
+	machs := make(map[string]*IntfMachine, len(mgr.interfaces))
+	for name, intf := range mgr.interfaces {
+		machs[name] = intf
+	}
+	return machs
+}
+
+// applyingInterfaces lists the managed interfaces with a commit in
+// progress, applying or removing configuration.
+func (mgr *IntfManager) applyingInterfaces() []string {
+	out := make([]string, 0)
+	for name, intf := range mgr.machines() {
+		state, _, ok := intf.TimeInState()
+		if ok && (state == applying || state == unapplying) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// stalledApplies lists interfaces whose configuration has been waiting
+// to be applied for longer than the configured threshold.
+func (mgr *IntfManager) stalledApplies() []string {
+	mgr.Lock()
+	defer mgr.Unlock()
+	out := make([]string, 0)
+	if mgr.cfg.ApplyLagThreshold <= 0 {
+		return out
+	}
+	for name, intf := range mgr.interfaces {
+		if intf.ApplyLag() > mgr.cfg.ApplyLagThreshold {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+type TypeSummary struct {
+	Type       string `json:"type"`
+	Configured int    `json:"configured"`
+	Managed    int    `json:"managed"`
+	Plugged    int    `json:"plugged"`
+}
+
+// typeSummary counts, for each of the supplied interface types, the
+// configured, managed and plugged instances of that type.
+func (mgr *IntfManager) typeSummary(types []string) []*TypeSummary {
+	byType := make(map[string]*TypeSummary)
+	out := make([]*TypeSummary, 0, len(types))
+	for _, typ := range types {
+		sum := &TypeSummary{Type: typ}
+		byType[typ] = sum
+		out = append(out, sum)
+	}
+
+	// the machines are asked whether they are plugged once the
+	// manager is unlocked
+	type managedIntf struct {
+		intf *IntfMachine
+		sum  *TypeSummary
+	}
+	var managed []managedIntf
+	mgr.Lock()
+	if mgr.config != nil {
+		for _, ifType := range mgr.config.Child("interfaces").Children() {
+			sum, ok := byType[ifType.Name()]
+			if !ok {
+				continue
+			}
+			for _, name := range ifType.ChildNames() {
+				sum.Configured++
+				if intf, ok := mgr.interfaces[name]; ok {
+					sum.Managed++
+					managed = append(managed, managedIntf{intf, sum})
+				}
+			}
+		}
+	}
+	mgr.Unlock()
+
+	for _, m := range managed {
+		if m.intf.IsPlugged() {
+			m.sum.Plugged++
+		}
+	}
+	return out
+}
+
+// OperationalState is an interface's ifmgr-state as RFC7951 state data
+type OperationalState struct {
+	State           string `json:"state"`
+	Plugged         bool   `json:"plugged"`
+	LastApply       string `json:"last-apply,omitempty"`
+	LastError       string `json:"last-error,omitempty"`
+	LastTransaction string `json:"last-transaction,omitempty"`
+	// never plugged within the never-plugged timeout
+	WaitingForHardware bool `json:"waiting-for-hardware,omitempty"`
+}
+
+func (mgr *IntfManager) operationalState(intfName string) (*OperationalState, bool) {
+	mgr.Lock()
+	intf, managed := mgr.interfaces[intfName]
+	mgr.Unlock()
+	if !managed {
+		return nil, false
+	}
+	out := &OperationalState{}
+	intf.inspect(func(m *IntfMachine) {
+		out.State = strings.ToLower(m.curState.String())
+		out.Plugged = m.plugged
+		out.WaitingForHardware = m.waitingHardware
+	})
+	if res := intf.lastResult(); res != nil {
+		out.LastApply = res.completed.Format(time.RFC3339)
+		out.LastTransaction = res.txn
+		if res.err != nil {
+			out.LastError = res.err.Error()
+		}
+	}
+	return out, true
+}
+
+// interfaceStates returns the state of each named interface, or of
+// every managed interface if names is empty. Returns the first name
+// that is not managed, if any.
+func (mgr *IntfManager) interfaceStates(
+	names []string,
+) (map[string]string, string) {
+	mgr.Lock()
+	machs := make(map[string]*IntfMachine)
+	if len(names) == 0 {
+		for name, intf := range mgr.interfaces {
+			machs[name] = intf
+		}
+	}
+	for _, name := range names {
+		intf, managed := mgr.interfaces[name]
+		if !managed {
+			mgr.Unlock()
+			return nil, name
+		}
+		machs[name] = intf
+	}
+	mgr.Unlock()
+
+	out := make(map[string]string, len(machs))
+	for name, intf := range machs {
+		intf.inspect(func(m *IntfMachine) {
+			out[name] = strings.ToLower(m.curState.String())
+		})
+	}
+	return out, ""
+}
+
+// interfaceState returns the current state of a managed interface's
+// machine, read on the machine's goroutine.
+func (mgr *IntfManager) interfaceState(intfName string) (State, bool) {
+	mgr.Lock()
+	intf, managed := mgr.interfaces[intfName]
+	mgr.Unlock()
+	if !managed {
+		return 0, false
+	}
+	state, _, ok := intf.TimeInState()
+	return state, ok
+}
+
+type StateDuration struct {
+	State   string  `json:"state"`
+	Seconds float64 `json:"seconds"`
+}
+
+// lastOutput returns the output of the commit actions of a managed
+// interface's most recent successful commit, empty if none has
+// succeeded.
+func (mgr *IntfManager) lastOutput(intfName string) (string, bool) {
+	mgr.Lock()
+	intf, managed := mgr.interfaces[intfName]
+	mgr.Unlock()
+	if !managed {
+		return "", false
+	}
+	out, _ := intf.lastCommitOutput()
+	return out, true
+}
+
+// interfaceCounters reports the counters of a managed interface.
+func (mgr *IntfManager) interfaceCounters(
+	intfName string,
+) (*InterfaceCounters, bool) {
+	mgr.Lock()
+	intf, managed := mgr.interfaces[intfName]
+	mgr.Unlock()
+	if !managed {
+		return nil, false
+	}
+	return intf.eventCounters()
+}
+
+// timeInState reports how long a managed interface's machine has been
+// in its current state.
+func (mgr *IntfManager) timeInState(intfName string) (*StateDuration, bool) {
+	mgr.Lock()
+	intf, managed := mgr.interfaces[intfName]
+	mgr.Unlock()
+	if !managed {
+		return nil, false
+	}
+	state, d, ok := intf.TimeInState()
+	if !ok {
+		return nil, false
+	}
+	return &StateDuration{
+		State:   strings.ToLower(state.String()),
+		Seconds: d.Seconds(),
+	}, true
+}
+
+type LatencyStats struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50-seconds"`
+	P95     float64 `json:"p95-seconds"`
+	Max     float64 `json:"max-seconds"`
+}
+
+// latencyStats reports percentiles of how long a managed interface's
+// recent commits took.
+func (mgr *IntfManager) latencyStats(intfName string) (*LatencyStats, bool) {
+	mgr.Lock()
+	intf, managed := mgr.interfaces[intfName]
+	mgr.Unlock()
+	if !managed {
+		return nil, false
+	}
+	return newLatencyStats(intf.applyLatencies()), true
+}
+
+// newLatencyStats summarises durations using nearest-rank percentiles.
+func newLatencyStats(ds []time.Duration) *LatencyStats {
+	stats := &LatencyStats{Samples: len(ds)}
+	if len(ds) == 0 {
+		return stats
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	rank := func(pct int) time.Duration {
+		return ds[(pct*len(ds)+99)/100-1]
+	}
+	stats.P50 = rank(50).Seconds()
+	stats.P95 = rank(95).Seconds()
+	stats.Max = ds[len(ds)-1].Seconds()
+	return stats
+}
+
+type Stats struct {
+	Interfaces    int `json:"interfaces"`
+	MaxInterfaces int `json:"max-interfaces"`
+	Sessions      int `json:"sessions"`
+	MaxSessions   int `json:"max-sessions"`
+}
+
+func (mgr *IntfManager) stats(out *Stats) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	out.Interfaces = len(mgr.interfaces)
+	out.MaxInterfaces = mgr.cfg.MaxInterfaces
 }
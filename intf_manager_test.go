@@ -0,0 +1,771 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/danos/config/data"
+)
+
+type testIntf struct {
+	typ, name, description string
+}
+
+// Build a config tree of 'interfaces <type> <name> description <desc>'
+func testConfig(intfs ...testIntf) *data.Node {
+	root := data.New("root")
+	interfaces := data.New("interfaces")
+	root.AddChild(interfaces)
+	for _, intf := range intfs {
+		typ := interfaces.Child(intf.typ)
+		if typ == nil {
+			typ = data.New(intf.typ)
+			interfaces.AddChild(typ)
+		}
+		n := data.New(intf.name)
+		desc := data.New("description")
+		desc.AddChild(data.New(intf.description))
+		n.AddChild(desc)
+		typ.AddChild(n)
+	}
+	return root
+}
+
+// Wait for the machine to process outstanding messages and return
+// its candidate configuration.
+func testCandidate(t *testing.T, mach *IntfMachine) *data.Node {
+	var candidate *data.Node
+	if !mach.inspect(func(m *IntfMachine) {
+		candidate = m.candidate.Load()
+	}) {
+		t.Fatalf("Interface %s machine has shutdown", mach.ifname)
+	}
+	return candidate
+}
+
+func TestApplyOnlyChangedInterfaces(t *testing.T) {
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	mgr.Register("tst0s2")
+	defer mgr.Unregister("tst0s1")
+	defer mgr.Unregister("tst0s2")
+
+	first := testConfig(
+		testIntf{"dataplane", "tst0s1", "unchanged"},
+		testIntf{"dataplane", "tst0s2", "before"})
+	mgr.Apply(first)
+
+	second := testConfig(
+		testIntf{"dataplane", "tst0s1", "unchanged"},
+		testIntf{"dataplane", "tst0s2", "after"})
+	mgr.Apply(second)
+
+	if testCandidate(t, mgr.interfaces["tst0s1"]) != first {
+		t.Fatal("Unchanged interface tst0s1 was re-applied")
+	}
+	if testCandidate(t, mgr.interfaces["tst0s2"]) != second {
+		t.Fatal("Changed interface tst0s2 was not applied")
+	}
+}
+
+// Commits of an interface not re-applied are given the latest
+// configuration for reference, not that it was last applied with
+func TestUnchangedInterfaceCommitsSeeLatestConfig(t *testing.T) {
+	references := make(chan *data.Node, 10)
+	orig := commitIntf
+	commitIntf = func(name string, committer *Committer) (bool, error) {
+		references <- sessionmgr.Get(committer.sid).candidate
+		return true, nil
+	}
+	t.Cleanup(func() { commitIntf = orig })
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s20")
+	mgr.Register("tst0s21")
+	defer testUnregister(t, mgr, "tst0s20")
+	defer testUnregister(t, mgr, "tst0s21")
+
+	mgr.Apply(testConfig(
+		testIntf{"dataplane", "tst0s20", "unchanged"},
+		testIntf{"dataplane", "tst0s21", "before"}))
+	mgr.Plug("tst0s20")
+	testWaitState(t, mgr.interfaces["tst0s20"], plugged)
+	<-references
+
+	second := testConfig(
+		testIntf{"dataplane", "tst0s20", "unchanged"},
+		testIntf{"dataplane", "tst0s21", "after"})
+	mgr.Apply(second)
+	mgr.Reconcile("tst0s20")
+	if ref := <-references; ref != second {
+		t.Fatal("Commit not given the latest configuration for reference")
+	}
+}
+
+func TestApplyResetsOnlyRemovedInterfaces(t *testing.T) {
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	mgr.Register("tst0s2")
+	mgr.Register("tst0s3")
+	defer mgr.Unregister("tst0s1")
+	defer mgr.Unregister("tst0s2")
+	defer mgr.Unregister("tst0s3")
+
+	first := testConfig(
+		testIntf{"dataplane", "tst0s1", "kept"},
+		testIntf{"dataplane", "tst0s2", "removed"})
+	mgr.Apply(first)
+
+	second := testConfig(
+		testIntf{"dataplane", "tst0s1", "kept"})
+	mgr.Apply(second)
+
+	if testCandidate(t, mgr.interfaces["tst0s2"]) != second {
+		t.Fatal("Removed interface tst0s2 was not reset")
+	}
+	if testCandidate(t, mgr.interfaces["tst0s3"]) != first {
+		t.Fatal("Unconfigured interface tst0s3 was needlessly reset")
+	}
+}
+
+func TestApplyDebounceAppliesLastConfig(t *testing.T) {
+	mgr := NewIntfManager()
+	mgr.configure(&Config{ApplyDebounce: 50 * time.Millisecond})
+	mgr.Register("tst0s1")
+	defer mgr.Unregister("tst0s1")
+
+	first := testConfig(testIntf{"dataplane", "tst0s1", "first"})
+	last := testConfig(testIntf{"dataplane", "tst0s1", "last"})
+	mgr.Apply(first)
+	mgr.Apply(last)
+
+	if testCandidate(t, mgr.interfaces["tst0s1"]) != nil {
+		t.Fatal("Configuration applied before debounce window expired")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if testCandidate(t, mgr.interfaces["tst0s1"]) != last {
+		t.Fatal("Last configuration in debounce window was not applied")
+	}
+}
+
+func TestApplyIdenticalConfigCommitsOnce(t *testing.T) {
+	rec := newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+
+	// equal but distinct trees, as from two identical configd commits
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "same"}))
+	mgr.Plug("tst0s1")
+	testWaitState(t, mgr.interfaces["tst0s1"], plugged)
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "same"}))
+	testWaitState(t, mgr.interfaces["tst0s1"], plugged)
+
+	if commits := rec.Commits(); len(commits) != 1 {
+		t.Fatalf("Expected 1 commit, got %d", len(commits))
+	}
+}
+
+func TestApplyAutoRegister(t *testing.T) {
+	mgr := NewIntfManager()
+	mgr.configure(&Config{AutoRegister: true})
+	config := testConfig(testIntf{"dataplane", "tst0s1", "auto"})
+	mgr.Apply(config)
+
+	mach, managed := mgr.interfaces["tst0s1"]
+	if !managed {
+		t.Fatal("Configured interface was not registered")
+	}
+	defer testUnregister(t, mgr, "tst0s1")
+	if testCandidate(t, mach) != config {
+		t.Fatal("Registered interface did not receive the configuration")
+	}
+}
+
+func TestManageAllowlistRefusesOthers(t *testing.T) {
+	mgr := NewIntfManager()
+	mgr.configure(&Config{
+		AutoRegister:    true,
+		ManageAllowlist: []string{"tst0s1*"},
+	})
+	if err := mgr.Register("tst0s2"); err == nil {
+		t.Fatal("Interface outside the allowlist was registered")
+	}
+	mgr.Apply(testConfig(
+		testIntf{"dataplane", "tst0s10", "allowed"},
+		testIntf{"dataplane", "tst0s2", "refused"}))
+	defer testUnregister(t, mgr, "tst0s10")
+
+	if _, managed := mgr.interfaces["tst0s10"]; !managed {
+		t.Fatal("Allowed interface was not auto-registered")
+	}
+	if _, managed := mgr.interfaces["tst0s2"]; managed {
+		t.Fatal("Interface outside the allowlist was auto-registered")
+	}
+}
+
+func TestApplyDispatchOrderIsSorted(t *testing.T) {
+	names := []string{"tst0s3", "tst0s1", "tst0s4", "tst0s2"}
+	mgr := NewIntfManager()
+	for _, name := range names {
+		mgr.Register(name)
+		defer testUnregister(t, mgr, name)
+	}
+
+	// config order differs from name order
+	intfs := make([]testIntf, 0, len(names))
+	for _, name := range names {
+		intfs = append(intfs, testIntf{"dataplane", name, "first"})
+	}
+	want := []string{"tst0s1", "tst0s2", "tst0s3", "tst0s4"}
+	for run := 0; run < 10; run++ {
+		for i := range intfs {
+			intfs[i].description = fmt.Sprint("run ", run)
+		}
+		mgr.Lock()
+		applied, _ := mgr.dispatch(testConfig(intfs...))
+		mgr.Unlock()
+		if !reflect.DeepEqual(applied, want) {
+			t.Fatalf("Run %d applied in order %v, expected %v",
+				run, applied, want)
+		}
+	}
+
+	mgr.Lock()
+	_, reset := mgr.dispatch(testConfig())
+	mgr.Unlock()
+	if !reflect.DeepEqual(reset, want) {
+		t.Fatalf("Reset in order %v, expected %v", reset, want)
+	}
+}
+
+func TestPendingInterfaces(t *testing.T) {
+	// hold tst0s2's commit until released
+	release := make(chan struct{})
+	orig := commitIntf
+	commitIntf = func(name string, committer *Committer) (bool, error) {
+		if name == "tst0s2" {
+			<-release
+		}
+		return true, nil
+	}
+	defer func() { commitIntf = orig }()
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mgr.Register("tst0s2")
+	defer testUnregister(t, mgr, "tst0s2")
+	mgr.Register("tst0s3")
+	defer testUnregister(t, mgr, "tst0s3")
+
+	mgr.Apply(testConfig(
+		testIntf{"dataplane", "tst0s1", "applied"},
+		testIntf{"dataplane", "tst0s2", "pending"},
+		testIntf{"dataplane", "tst0s3", "unplugged"}))
+	mgr.Plug("tst0s1")
+	mgr.Plug("tst0s2")
+	testWaitState(t, mgr.interfaces["tst0s1"], plugged)
+
+	out := mgr.pendingInterfaces()
+	if !reflect.DeepEqual(out, []string{"tst0s2"}) {
+		t.Fatalf("Pending interfaces %v, expected [tst0s2]", out)
+	}
+	out = mgr.applyingInterfaces()
+	if !reflect.DeepEqual(out, []string{"tst0s2"}) {
+		t.Fatalf("Applying interfaces %v, expected [tst0s2]", out)
+	}
+	close(release)
+	testWaitState(t, mgr.interfaces["tst0s2"], plugged)
+	if out := mgr.pendingInterfaces(); len(out) != 0 {
+		t.Fatalf("Pending interfaces %v after convergence", out)
+	}
+	if out := mgr.applyingInterfaces(); len(out) != 0 {
+		t.Fatalf("Applying interfaces %v after convergence", out)
+	}
+}
+
+func TestInterfaceState(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	if _, managed := mgr.interfaceState("tst0s1"); managed {
+		t.Fatal("State reported for an unmanaged interface")
+	}
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	if state, _ := mgr.interfaceState("tst0s1"); state != unplugged {
+		t.Fatalf("Registered interface is %s", state)
+	}
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "plugged"}))
+	mgr.Plug("tst0s1")
+	testWaitState(t, mgr.interfaces["tst0s1"], plugged)
+	if state, _ := mgr.interfaceState("tst0s1"); state != plugged {
+		t.Fatalf("Plugged interface is %s", state)
+	}
+}
+
+func TestInterfaceStates(t *testing.T) {
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mgr.Register("tst0s2")
+	defer testUnregister(t, mgr, "tst0s2")
+
+	all, unmanaged := mgr.interfaceStates(nil)
+	want := map[string]string{"tst0s1": "unplugged", "tst0s2": "unplugged"}
+	if unmanaged != "" || !reflect.DeepEqual(all, want) {
+		t.Fatalf("States %v, expected %v", all, want)
+	}
+	one, _ := mgr.interfaceStates([]string{"tst0s2"})
+	if !reflect.DeepEqual(one, map[string]string{"tst0s2": "unplugged"}) {
+		t.Fatalf("Unexpected states %v for tst0s2", one)
+	}
+	if _, unmanaged := mgr.interfaceStates(
+		[]string{"tst0s1", "tst0s3"}); unmanaged != "tst0s3" {
+		t.Fatalf("Reported %q unmanaged, expected tst0s3", unmanaged)
+	}
+}
+
+func TestRegistrationsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registered")
+	cfg := &Config{RegistrationFile: path}
+
+	mgr := NewIntfManager()
+	mgr.configure(cfg)
+	mgr.Register("tst0s1")
+	mgr.Register("tst0s2")
+	mgr.Register("tst0s1")
+	testUnregister(t, mgr, "tst0s2")
+	defer testUnregister(t, mgr, "tst0s1")
+
+	restarted := NewIntfManager()
+	restarted.configure(cfg)
+	if err := restarted.LoadRegistrations(); err != nil {
+		t.Fatal(err)
+	}
+	defer testUnregister(t, restarted, "tst0s1")
+	if out := restarted.managedInterfaces(); !reflect.DeepEqual(
+		out, []string{"tst0s1"}) {
+		t.Fatalf("Restored %v, expected [tst0s1]", out)
+	}
+}
+
+func TestPollPluggedMatchesSystem(t *testing.T) {
+	newTestCommitRecorder(t)
+	present := map[string]bool{"tst0s1": true}
+	orig := interfacePresent
+	interfacePresent = func(name string) bool { return present[name] }
+	defer func() { interfacePresent = orig }()
+
+	mgr := NewIntfManager()
+	mgr.Apply(testConfig(
+		testIntf{"dataplane", "tst0s1", "present"},
+		testIntf{"dataplane", "tst0s2", "absent"}))
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mgr.Register("tst0s2")
+	defer testUnregister(t, mgr, "tst0s2")
+	testWaitState(t, mgr.interfaces["tst0s1"], plugged)
+
+	// tst0s1 is removed and tst0s2 added without plug events
+	present = map[string]bool{"tst0s2": true}
+	mgr.pollPlugged()
+	testWaitState(t, mgr.interfaces["tst0s1"], unplugged)
+	testWaitState(t, mgr.interfaces["tst0s2"], plugged)
+}
+
+func TestApplyDoesNotWaitForWedgedMachine(t *testing.T) {
+	newTestCommitRecorder(t)
+	orig := dispatchTimeout
+	dispatchTimeout = 10 * time.Millisecond
+	defer func() { dispatchTimeout = orig }()
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mach := mgr.interfaces["tst0s1"]
+
+	// wedge the machine until released
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	go mach.inspect(func(*IntfMachine) {
+		close(busy)
+		<-release
+	})
+	<-busy
+
+	applied := make(chan struct{})
+	go func() {
+		mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "first"}))
+		mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "second"}))
+		close(applied)
+	}()
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Apply blocked on a wedged machine")
+	}
+	close(release)
+
+	want := testConfig(testIntf{"dataplane", "tst0s1", "second"})
+	deadline := time.Now().Add(5 * time.Second)
+	for !treesEqual(testCandidate(t, mach), want) {
+		if time.Now().After(deadline) {
+			t.Fatal("Machine did not settle on the last configuration")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCandidateRunningSnapshot(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	if _, _, managed := mgr.candidateRunning("tst0s1"); managed {
+		t.Fatal("Unregistered interface reported as managed")
+	}
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+
+	// unplugged, so the configuration is staged but not applied
+	config := testConfig(testIntf{"dataplane", "tst0s1", "staged"})
+	mgr.Apply(config)
+	candidate, running, managed := mgr.candidateRunning("tst0s1")
+	if !managed {
+		t.Fatal("Registered interface not managed")
+	}
+	if !treesEqual(candidate, findCommitRoot("tst0s1", config)) {
+		t.Fatal("Candidate is not the applied configuration")
+	}
+	if len(running.Children()) != 0 {
+		t.Fatal("Running configuration of an unplugged interface is not empty")
+	}
+}
+
+// However many configurations arrive while a machine is wedged, at
+// most one waits to be delivered and the machine receives the latest.
+func TestApplyFloodKeepsOnlyLatest(t *testing.T) {
+	newTestCommitRecorder(t)
+	orig := dispatchTimeout
+	dispatchTimeout = 10 * time.Millisecond
+	defer func() { dispatchTimeout = orig }()
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mach := mgr.interfaces["tst0s1"]
+
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	go mach.inspect(func(*IntfMachine) {
+		close(busy)
+		<-release
+	})
+	<-busy
+
+	before := metrics.Snapshot()["applies-dropped"]
+	for i := 0; i < 5; i++ {
+		mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1",
+			fmt.Sprint("flood", i)}))
+	}
+	if dropped := metrics.Snapshot()["applies-dropped"] - before; dropped < 3 {
+		t.Fatalf("%d superseded applies dropped, expected at least 3",
+			dropped)
+	}
+	close(release)
+
+	want := testConfig(testIntf{"dataplane", "tst0s1", "flood4"})
+	deadline := time.Now().Add(5 * time.Second)
+	for !treesEqual(testCandidate(t, mach), want) || mach.backlogged() {
+		if time.Now().After(deadline) {
+			t.Fatal("Machine did not settle on the last configuration")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApplyInterfaceLeavesOthers(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	mgr.Register("tst0s2")
+	defer testUnregister(t, mgr, "tst0s1")
+	defer testUnregister(t, mgr, "tst0s2")
+
+	mgr.Apply(testConfig(
+		testIntf{"dataplane", "tst0s1", "one"},
+		testIntf{"dataplane", "tst0s2", "two"}))
+	if mgr.ApplyInterface("tst0s3", testConfig(
+		testIntf{"dataplane", "tst0s1", "one"})) {
+		t.Fatal("Applied an interface missing from the configuration")
+	}
+	if !mgr.ApplyInterface("tst0s1", testConfig(
+		testIntf{"dataplane", "tst0s1", "changed"},
+		testIntf{"dataplane", "tst0s2", "ignored"})) {
+		t.Fatal("Failed to apply tst0s1")
+	}
+
+	// machines are sent the whole configuration
+	want := testConfig(
+		testIntf{"dataplane", "tst0s1", "changed"},
+		testIntf{"dataplane", "tst0s2", "two"})
+	if got := testCandidate(t, mgr.interfaces["tst0s1"]); !treesEqual(got, want) {
+		t.Fatal("tst0s1 configuration not applied")
+	}
+	if testCandidate(t, mgr.interfaces["tst0s2"]) == want {
+		t.Fatal("Unchanged tst0s2 was re-applied")
+	}
+}
+
+func TestApplyInterfaceCASRejectsStaleGeneration(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+
+	mgr.Apply(testConfig(
+		testIntf{"dataplane", "tst0s1", "one"},
+		testIntf{"dataplane", "tst0s2", "two"}))
+	gen := mgr.applyGeneration("tst0s1")
+	if gen != 1 {
+		t.Fatalf("Generation %d after first apply, expected 1", gen)
+	}
+
+	// another writer changes the interface
+	mgr.ApplyInterface("tst0s1", testConfig(
+		testIntf{"dataplane", "tst0s1", "theirs"}))
+	applied, found := mgr.ApplyInterfaceCAS("tst0s1", gen, testConfig(
+		testIntf{"dataplane", "tst0s1", "mine"}))
+	if applied || !found {
+		t.Fatalf("Stale generation gave applied %v, found %v",
+			applied, found)
+	}
+	want := testConfig(
+		testIntf{"dataplane", "tst0s1", "theirs"},
+		testIntf{"dataplane", "tst0s2", "two"})
+	if !treesEqual(mgr.lastConfig(), want) {
+		t.Fatal("Stale update was applied")
+	}
+
+	gen = mgr.applyGeneration("tst0s1")
+	applied, _ = mgr.ApplyInterfaceCAS("tst0s1", gen, testConfig(
+		testIntf{"dataplane", "tst0s1", "mine"}))
+	if !applied {
+		t.Fatal("Current generation not applied")
+	}
+	if got := mgr.applyGeneration("tst0s1"); got != gen+1 {
+		t.Fatalf("Generation %d after apply, expected %d", got, gen+1)
+	}
+	if got := mgr.applyGeneration("tst0s2"); got != 1 {
+		t.Fatalf("Unchanged tst0s2 at generation %d, expected 1", got)
+	}
+	if _, found := mgr.ApplyInterfaceCAS("tst0s3", 0, testConfig(
+		testIntf{"dataplane", "tst0s1", "mine"})); found {
+		t.Fatal("Applied an interface missing from the configuration")
+	}
+}
+
+func TestDecommissionIsNotAutoRegistered(t *testing.T) {
+	rec := newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.configure(&Config{AutoRegister: true})
+	config := testConfig(testIntf{"dataplane", "tst0s1", "retired"})
+	mgr.Apply(config)
+	mach := mgr.interfaces["tst0s1"]
+	if mach == nil {
+		t.Fatal("tst0s1 not registered automatically")
+	}
+	mgr.Plug("tst0s1")
+	testWaitState(t, mach, plugged)
+
+	if !mgr.Decommission("tst0s1") {
+		t.Fatal("Failed to decommission tst0s1")
+	}
+	commits := rec.Commits()
+	if last := commits[len(commits)-1]; last.candidate != nil {
+		t.Fatal("Configuration not removed by decommission")
+	}
+	if mgr.Decommission("tst0s1") {
+		t.Fatal("Decommissioned an unmanaged interface")
+	}
+
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "again"}))
+	if _, managed := mgr.interfaces["tst0s1"]; managed {
+		t.Fatal("Decommissioned interface registered automatically")
+	}
+	mgr.Register("tst0s1")
+	testUnregister(t, mgr, "tst0s1")
+	if _, gone := mgr.decommissioned["tst0s1"]; gone {
+		t.Fatal("Registering did not recommission tst0s1")
+	}
+}
+
+// An interface with apply-after is not committed until its dependency
+// has converged
+func TestApplyAfterWaitsForDependency(t *testing.T) {
+	release := make(chan struct{})
+	committed := make(chan string, 4)
+	orig := commitIntf
+	commitIntf = func(name string, _ *Committer) (bool, error) {
+		if name == "tst0s2" {
+			<-release
+		}
+		committed <- name
+		return true, nil
+	}
+	t.Cleanup(func() { commitIntf = orig })
+
+	mgr := NewIntfManager()
+	for _, name := range []string{"tst0s1", "tst0s2"} {
+		mgr.Register(name)
+		defer testUnregister(t, mgr, name)
+		mgr.Plug(name)
+	}
+	config := testConfig(
+		testIntf{"tunnel", "tst0s1", "tunnel"},
+		testIntf{"dataplane", "tst0s2", "transport"})
+	dep := data.New("apply-after")
+	dep.AddChild(data.New("tst0s2"))
+	config.Child("interfaces").Child("tunnel").Child("tst0s1").AddChild(dep)
+	mgr.Apply(config)
+
+	select {
+	case name := <-committed:
+		t.Fatalf("%s committed before its dependency", name)
+	case <-time.After(3 * applyAfterPoll):
+	}
+	close(release)
+	for _, want := range []string{"tst0s2", "tst0s1"} {
+		select {
+		case name := <-committed:
+			if name != want {
+				t.Fatalf("%s committed, expected %s", name, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not committed", want)
+		}
+	}
+}
+
+func TestResetInterfaceKeepsManaging(t *testing.T) {
+	rec := newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	if mgr.ResetInterface("tst0s1") {
+		t.Fatal("Reset an unmanaged interface")
+	}
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mach := mgr.interfaces["tst0s1"]
+	config := testConfig(testIntf{"dataplane", "tst0s1", "reset"})
+	mgr.Apply(config)
+	mgr.Plug("tst0s1")
+	testWaitState(t, mach, plugged)
+
+	if !mgr.ResetInterface("tst0s1") {
+		t.Fatal("Failed to reset tst0s1")
+	}
+	testWaitState(t, mach, plugged)
+	commits := rec.Commits()
+	if last := commits[len(commits)-1]; last.candidate != nil {
+		t.Fatal("Configuration not removed by reset")
+	}
+
+	// the same configuration applied again configures it again
+	mgr.Apply(config)
+	testWaitState(t, mach, plugged)
+	commits = rec.Commits()
+	if last := commits[len(commits)-1]; last.candidate == nil {
+		t.Fatal("Configuration not applied again after reset")
+	}
+}
+
+func TestRemovedInterfaceIsReset(t *testing.T) {
+	rec := newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	mgr.Register("tst0s2")
+	defer testUnregister(t, mgr, "tst0s1")
+	defer testUnregister(t, mgr, "tst0s2")
+	mach := mgr.interfaces["tst0s2"]
+	mgr.Apply(testConfig(
+		testIntf{"dataplane", "tst0s1", "kept"},
+		testIntf{"dataplane", "tst0s2", "removed"}))
+	mgr.Plug("tst0s2")
+	testWaitState(t, mach, plugged)
+
+	mgr.ApplyTxn(testConfig(testIntf{"dataplane", "tst0s1", "kept"}), "txn1")
+	testWaitNotified(t, "interface-config-removed", func(n interface{}) bool {
+		r, ok := n.(*InterfaceConfigRemoved)
+		return ok && r.Interface.Name == "tst0s2" && r.Transaction == "txn1"
+	})
+	testWaitState(t, mach, plugged)
+	commits := rec.Commits()
+	last := commits[len(commits)-1]
+	if last.intf != "tst0s2" || last.candidate != nil {
+		t.Fatal("Configuration of removed tst0s2 not unapplied")
+	}
+	if running, _ := mgr.running("tst0s2"); running != nil {
+		t.Fatal("Removed tst0s2 still has running configuration")
+	}
+}
+
+// An interface absent from the first configuration never had any to
+// remove, so no removal is notified
+func TestFirstConfigNotifiesNoRemoval(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.Register("tst0s16")
+	defer testUnregister(t, mgr, "tst0s16")
+	mgr.Plug("tst0s16")
+	mach := mgr.interfaces["tst0s16"]
+	testWaitState(t, mach, plugged)
+
+	mgr.ApplyTxn(testConfig(testIntf{"dataplane", "tst0s1", "other"}), "txn1")
+	testWaitState(t, mach, plugged)
+	testNotifications.Lock()
+	defer testNotifications.Unlock()
+	for _, n := range testNotifications.sent {
+		if r, ok := n.object.(*InterfaceConfigRemoved); ok &&
+			r.Interface.Name == "tst0s16" {
+			t.Fatal("Removal notified for tst0s16's first configuration")
+		}
+	}
+}
+
+func TestLastConfigIsWholeConfig(t *testing.T) {
+	mgr := NewIntfManager()
+	if mgr.lastConfig() != nil {
+		t.Fatal("Configuration reported before any was applied")
+	}
+	// kept even though no interface is managed
+	config := testConfig(testIntf{"dataplane", "tst0s1", "unmanaged"})
+	mgr.Apply(config)
+	if mgr.lastConfig() != config {
+		t.Fatal("Last applied configuration not reported")
+	}
+}
+
+// Latency percentiles cover only the most recent commits
+func TestLatencyStatsKeepsRecentCommits(t *testing.T) {
+	mach := &IntfMachine{}
+	for i := 1; i <= 100; i++ {
+		mach.recordLatency(time.Duration(i) * time.Millisecond)
+	}
+	stats := newLatencyStats(mach.applyLatencies())
+	expect := &LatencyStats{
+		Samples: latencyHistory,
+		P50:     0.068,
+		P95:     0.097,
+		Max:     0.1,
+	}
+	if *stats != *expect {
+		t.Fatalf("Latency stats %+v, expected %+v", stats, expect)
+	}
+}
@@ -9,40 +9,116 @@
 package ifmgrd
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"github.com/danos/vci"
 	"github.com/danos/config/commit"
 	"github.com/danos/config/data"
 	"github.com/danos/config/diff"
+	"github.com/danos/utils/exec"
 )
 
+// notify emits a notification over VCI and to the event socket
+func (mach *IntfMachine) notify(name string, object interface{}) {
+	notifications.Send("vyatta-ifmgr-v1", name, object)
+	events.Publish(name, mach.ifname, object)
+}
+
 type ConfigurationUpdated struct {
 	Interface struct {
-		Name string `rfc7951:"name"`
-	} `rfc7951:"vyatta-ifmgr-v1:interface"`
+		Name string `rfc7951:"name" json:"name"`
+	} `rfc7951:"vyatta-ifmgr-v1:interface" json:"interface"`
+	Transaction string `rfc7951:"vyatta-ifmgr-v1:transaction,omitempty" json:"transaction,omitempty"`
 }
 
-func (mach *IntfMachine) notifyConfigUpdated() {
+// notifyConfigUpdated notifies the configuration applied, identified
+// by the transaction id supplied with it, if any.
+func (mach *IntfMachine) notifyConfigUpdated(txn string) {
 	var cu ConfigurationUpdated
 	cu.Interface.Name = mach.ifname
-	vci.EmitNotification("vyatta-ifmgr-v1", "configuration-updated", &cu)
+	cu.Transaction = txn
+	mach.notify("configuration-updated", &cu)
+}
+
+type InterfaceConfigRemoved struct {
+	Interface struct {
+		Name string `rfc7951:"name" json:"name"`
+	} `rfc7951:"vyatta-ifmgr-v1:interface" json:"interface"`
+	Transaction string `rfc7951:"vyatta-ifmgr-v1:transaction,omitempty" json:"transaction,omitempty"`
+}
+
+// notifyConfigRemoved notifies that the interface is absent from the
+// configuration identified by txn, so its configuration is removed.
+func (mach *IntfMachine) notifyConfigRemoved(txn string) {
+	var r InterfaceConfigRemoved
+	r.Interface.Name = mach.ifname
+	r.Transaction = txn
+	mach.notify("interface-config-removed", &r)
 }
 
 type InterfaceState struct {
 	Interface struct {
-		Name  string `rfc7951:"name"`
-		State string `rfc7951:"state"`
-	} `rfc7951:"vyatta-ifmgr-v1:interface"`
+		Name   string `rfc7951:"name" json:"name"`
+		State  string `rfc7951:"state" json:"state"`
+		Reason string `rfc7951:"reason,omitempty" json:"reason,omitempty"`
+	} `rfc7951:"vyatta-ifmgr-v1:interface" json:"interface"`
 }
 
-func (mach *IntfMachine) notifyInterfaceState(state string) {
+// notifyInterfaceState notifies the interface's plugged state, with the
+// reason or source of the plug or unplug that changed it, if given.
+func (mach *IntfMachine) notifyInterfaceState(state, reason string) {
 	var s InterfaceState
 	s.Interface.Name = mach.ifname
 	s.Interface.State = state
-	vci.EmitNotification("vyatta-ifmgr-v1", "interface-state", &s)
+	s.Interface.Reason = reason
+	mach.notify("interface-state", &s)
+}
+
+type ApplyTimeout struct {
+	Interface struct {
+		Name  string `rfc7951:"name" json:"name"`
+		State string `rfc7951:"state" json:"state"`
+	} `rfc7951:"vyatta-ifmgr-v1:interface" json:"interface"`
+}
+
+type InterfaceUnmanaged struct {
+	Interface struct {
+		Name string `rfc7951:"name" json:"name"`
+	} `rfc7951:"vyatta-ifmgr-v1:interface" json:"interface"`
+}
+
+func (mach *IntfMachine) notifyUnmanaged() {
+	var u InterfaceUnmanaged
+	u.Interface.Name = mach.ifname
+	mach.notify("interface-unmanaged", &u)
+}
+
+type WaitingForHardware struct {
+	Interface struct {
+		Name string `rfc7951:"name" json:"name"`
+	} `rfc7951:"vyatta-ifmgr-v1:interface" json:"interface"`
+}
+
+func (mach *IntfMachine) notifyWaitingForHardware() {
+	var w WaitingForHardware
+	w.Interface.Name = mach.ifname
+	mach.notify("waiting-for-hardware", &w)
+}
+
+func (mach *IntfMachine) notifyApplyTimeout(state State) {
+	var t ApplyTimeout
+	t.Interface.Name = mach.ifname
+	t.Interface.State = strings.ToLower(state.String())
+	mach.notify("apply-timeout", &t)
 }
 
 type State uint32
@@ -85,6 +161,10 @@ const (
 	isShutdown
 	kill
 	done
+	query
+	stuck
+	reconcile
+	neverPlugged
 )
 
 func (t messageType) String() string {
@@ -105,22 +185,61 @@ func (t messageType) String() string {
 		return "Kill"
 	case done:
 		return "Done"
+	case query:
+		return "Query"
+	case stuck:
+		return "Stuck"
+	case reconcile:
+		return "Reconcile"
+	case neverPlugged:
+		return "NeverPlugged"
 	}
 	return "Unknown"
 }
 
 type message struct {
-	typ  messageType
-	data interface{}
+	typ      messageType
+	data     interface{}
+	received time.Time
+	// caller's id for the configuration of an apply or reset
+	txn string
+	// orders the configurations dispatched by the manager, zero for
+	// messages sent otherwise
+	seq uint64
 }
 
 type TransFn func(*IntfMachine, interface{}) State
 
+// transition is the handling of an event in a state. Handlers choose
+// their next state at run time, so the states each may move the
+// machine to are listed alongside it.
+type transition struct {
+	handle  TransFn
+	targets []State
+}
+
+// leadsTo reports whether the transition lists state as a target.
+func (t transition) leadsTo(state State) bool {
+	for _, to := range t.targets {
+		if to == state {
+			return true
+		}
+	}
+	return false
+}
+
 // find 'interfaces <type> <name>' and create a dummy path
 // to only that node.
 func findCommitRoot(name string, tree *data.Node) *data.Node {
+	// no configuration has been applied yet
+	if tree == nil {
+		return nil
+	}
 	path := []string{"interfaces"}
 	intfTree := tree.Child("interfaces")
+	if intfTree == nil {
+		return nil
+	}
 	for _, intfType := range intfTree.Children() {
 		pathToType := append(path, intfType.Name())
 		for _, intf := range intfType.Children() {
@@ -140,69 +259,333 @@ func findCommitRoot(name string, tree *data.Node) *data.Node {
 	return nil
 }
 
-func (mach *IntfMachine) newSession() string {
-	schema := SchemaTree.Load()
-	sid := "INTF_" + mach.ifname + "_" + time.Now().String()
-	candidate := mach.candidate.Load()
-	running := mach.running.Load()
-	/*
-	 * The session needs the whole tree for reference, but
-	 * we only apply the interface nodes.
-	 */
+const sessionPrefix = "INTF_"
+
+// sessionSeq numbers the sessions created for commits
+var sessionSeq uint64
+
+// newSessionId returns an id for a commit session of the interface,
+// INTF_<name>_<n>, unique for the life of the daemon.
+func newSessionId(ifname string) string {
+	n := atomic.AddUint64(&sessionSeq, 1)
+	return sessionPrefix + ifname + "_" + strconv.FormatUint(n, 10)
+}
 
-	intfCandidate := findCommitRoot(mach.ifname, candidate)
-	intfRunning := findCommitRoot(mach.ifname, running)
-	sessionmgr.New(sid, intfCandidate, intfRunning, schema)
-	return sid
+// interfaceFromSid returns the interface whose commit created the
+// session, "" if the session was not created for a commit. Interface
+// names may contain '_' so the name runs to the last one.
+func interfaceFromSid(sid string) string {
+	if !strings.HasPrefix(sid, sessionPrefix) {
+		return ""
+	}
+	rest := sid[len(sessionPrefix):]
+	i := strings.LastIndexByte(rest, '_')
+	if i <= 0 {
+		return ""
+	}
+	if _, err := strconv.ParseUint(rest[i+1:], 10, 64); err != nil {
+		return ""
+	}
+	return rest[:i]
 }
 
-func applyIntf(name string, candidate, running *data.Node) bool {
+// applyIntf commits the changes between an interface's running and
+// candidate configuration, returning false if there were none, the
+// output of the commit actions, and any errors from them. It returns
+// false with an error if the commit could not be started, leaving the
+// running configuration as it was. current is the manager's latest
+// configuration, given to the commit for reference in place of the
+// candidate when the interface's configuration in it is the same.
+func applyIntf(
+	name string,
+	candidate, running, current *data.Node,
+) (bool, string, error) {
+	intfCandidate := findCommitRoot(name, candidate)
+	intfRunning := findCommitRoot(name, running)
+	if intfCandidate == intfRunning {
+		return false, "", nil
+	}
+
 	schema := SchemaTree.Load()
-	sid := "INTF_" + name + "_" + time.Now().String()
+	sid := newSessionId(name)
 	/*
 	 * The session needs the whole tree for reference, but
 	 * we only apply the interface nodes.
 	 */
-	sessionmgr.New(sid, candidate, running, schema)
+	reference := candidate
+	if current != nil &&
+		treesEqual(findCommitRoot(name, current), intfCandidate) {
+		reference = current
+	}
+	if _, err := sessionmgr.New(sid, reference, running, schema); err != nil {
+		return false, "", err
+	}
 	defer sessionmgr.Delete(sid)
 
-	intfCandidate := findCommitRoot(name, candidate)
-	intfRunning := findCommitRoot(name, running)
+	committer := NewCommitter(intfCandidate, intfRunning, schema, sid)
+	changes, err := commitIntf(name, committer)
+	return changes, committer.output, err
+}
 
+// commitIntf runs the commit actions for an interface's changes,
+// returning false if there were none, and any errors from the commit
+// actions. Tests replace it to observe what would be committed.
+var commitIntf = func(name string, committer *Committer) (bool, error) {
+	redact := newRedactor(intfmgr.settings().RedactPaths)
 	fmt.Println(name, "config differences:",
-		diff.NewNode(intfCandidate, intfRunning, schema, nil).Serialize(true))
-	if intfCandidate == intfRunning {
-		return false
-	}
+		diff.NewNode(
+			redact.tree(committer.Candidate(), committer.Schema()),
+			redact.tree(committer.Running(), committer.Schema()),
+			committer.Schema(), nil).Serialize(true))
 
-	committer := NewCommitter(intfCandidate, intfRunning, schema, sid)
 	if !commit.Changed(committer) {
-		return false
+		return false, nil
 	}
-	outs, errs := commitWorkers.Commit(committer)
+	if intfmgr.settings().Observe {
+		observeCommit(name, committer, redact)
+		return true, nil
+	}
+	outs, errs := commitWorkers.Commit(name, committer)
 	for _, out := range outs {
 		fmt.Println(out)
 	}
+	committer.output = commitOutput(outs, intfmgr.settings().MaxCommitOutput)
+	msgs := make([]string, 0, len(errs))
 	for _, err := range errs {
 		fmt.Fprintln(os.Stderr, err)
+		msgs = append(msgs, err.Error())
+	}
+	if len(msgs) != 0 {
+		return true, errors.New(strings.Join(msgs, "\n"))
+	}
+	return true, nil
+}
+
+// commitOutput joins the output of a commit's actions, keeping at most
+// max bytes, unlimited if max is zero. Output beyond that is dropped
+// and a marker saying how much is appended.
+func commitOutput(outs []*exec.Output, max int) string {
+	var b strings.Builder
+	dropped := 0
+	for _, out := range outs {
+		if out.Output == "" {
+			continue
+		}
+		text := out.Output
+		if b.Len() != 0 {
+			text = "\n" + text
+		}
+		room := len(text)
+		if max > 0 && b.Len()+room > max {
+			room = max - b.Len()
+			// don't split a multi-byte character
+			for room > 0 && !utf8.RuneStart(text[room]) {
+				room--
+			}
+		}
+		b.WriteString(text[:room])
+		dropped += len(text) - room
+	}
+	if dropped != 0 {
+		metrics.Inc("commit-output-truncated")
+		fmt.Fprintf(&b, "\n[output truncated, %d bytes dropped]", dropped)
+	}
+	return b.String()
+}
+
+// observeCommit logs the commit actions that would run for an
+// interface's changes without running them.
+func observeCommit(name string, committer *Committer, redact *redactor) {
+	metrics.Inc("commits-observed")
+	for _, act := range committer.Actions(false, redact) {
+		fmt.Println(name, "observe: would run", act.Phase,
+			strings.Join(act.Path, "/")+":", act.Script)
 	}
-	return true
 }
 
 type IntfMachine struct {
+	// Unix time in nanoseconds of the oldest configuration received
+	// but not yet applied, zero when the machine has settled. Accessed
+	// atomically so is kept first for alignment.
+	pendingSince int64
+	// messages sent to the machine but not yet received; the
+	// messages channel is unbuffered so these are blocked senders
+	pendingSends    int32
 	ifname          string
 	curState        State
 	messages        chan *message
 	done            chan struct{}
-	transitionTable map[State]map[messageType]TransFn
+	transitionTable map[State]map[messageType]transition
 	candidate       *data.AtomicNode
 	running         *data.AtomicNode
 	plugged         bool
 	killReq         bool
+	cfg             *Config
+	// the manager's latest configuration. The candidate is only
+	// replaced when the interface's configuration changes, so the
+	// rest of it may be out of date.
+	current *data.AtomicNode
+	// identifies the commit in progress so messages from an abandoned
+	// commit can be ignored
+	commitGen  uint64
+	watchdog   *time.Timer
+	lastCommit time.Time
+	// the last commit could not be started, so is retried after
+	// commitRetryInterval
+	commitNotStarted bool
+	// transaction id supplied with the candidate configuration
+	candidateTxn string
+	// seq of the last configuration dispatched to the machine
+	dispatchSeq uint64
+	// when the machine entered its current state
+	stateSince time.Time
+	// whether the interface has been plugged since it was registered,
+	// and whether it has been reported as waiting for hardware
+	everPlugged     bool
+	waitingHardware bool
+	// sends neverPlugged unless stopped by the first plug
+	neverPluggedTimer *time.Timer
+	// *applyResult of the most recent commit
+	lastApply atomic.Value
+	// output of the commit actions of the most recent successful
+	// commit
+	lastOutput atomic.Value
+	// configuration the manager could not deliver promptly, waiting
+	// to be sent by the backlog goroutine; only the newest is kept
+	backlogMu sync.Mutex
+	backlog   *message
+	draining  bool
+	// how long the most recent commits that changed the interface
+	// took, the oldest overwritten once the history is full
+	latencyMu   sync.Mutex
+	latencies   []time.Duration
+	latencyNext int
+	// counts of the events the machine has handled and of failed
+	// commits
+	counters InterfaceCounters
+}
+
+// InterfaceCounters counts what has happened to a managed interface
+// since it was registered. Fields are updated atomically.
+type InterfaceCounters struct {
+	Applies        uint32 `json:"applies"`
+	Resets         uint32 `json:"resets"`
+	Plugs          uint32 `json:"plugs"`
+	Unplugs        uint32 `json:"unplugs"`
+	CommitFailures uint32 `json:"commit-failures"`
+}
+
+// latencyHistory is how many commit durations each machine keeps.
+const latencyHistory = 64
+
+// logPrefix identifies the machine and its state in log messages. It
+// must only be used on the machine's goroutine.
+func (mach *IntfMachine) logPrefix() string {
+	return "[" + mach.ifname + " " +
+		strings.ToLower(mach.curState.String()) + "]"
+}
+
+func (mach *IntfMachine) log(v ...interface{}) {
+	fmt.Println(append([]interface{}{mach.logPrefix()}, v...)...)
+}
+
+func (mach *IntfMachine) logError(v ...interface{}) {
+	fmt.Fprintln(os.Stderr, append([]interface{}{mach.logPrefix()}, v...)...)
+}
+
+type applyResult struct {
+	completed time.Time
+	err       error
+	txn       string
+}
+
+func (mach *IntfMachine) recordApply(
+	started time.Time,
+	output string,
+	err error,
+	txn string,
+) {
+	completed := time.Now()
+	mach.recordLatency(completed.Sub(started))
+	if err == nil {
+		mach.lastOutput.Store(output)
+	} else {
+		atomic.AddUint32(&mach.counters.CommitFailures, 1)
+	}
+	mach.lastApply.Store(&applyResult{
+		completed: completed,
+		err:       err,
+		txn:       txn,
+	})
+	res := ApplyResult{Transaction: txn}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	events.Publish("apply-result", mach.ifname, &res)
+}
+
+func (mach *IntfMachine) recordLatency(d time.Duration) {
+	mach.latencyMu.Lock()
+	defer mach.latencyMu.Unlock()
+	if len(mach.latencies) < latencyHistory {
+		mach.latencies = append(mach.latencies, d)
+		return
+	}
+	mach.latencies[mach.latencyNext] = d
+	mach.latencyNext = (mach.latencyNext + 1) % latencyHistory
+}
+
+// applyLatencies returns how long the interface's recent commits took,
+// in no particular order.
+func (mach *IntfMachine) applyLatencies() []time.Duration {
+	mach.latencyMu.Lock()
+	defer mach.latencyMu.Unlock()
+	return append([]time.Duration(nil), mach.latencies...)
+}
+
+// countEvent counts an event handled by the machine.
+func (mach *IntfMachine) countEvent(typ messageType) {
+	switch typ {
+	case apply:
+		atomic.AddUint32(&mach.counters.Applies, 1)
+	case reset:
+		atomic.AddUint32(&mach.counters.Resets, 1)
+	case plug:
+		atomic.AddUint32(&mach.counters.Plugs, 1)
+	case unplug:
+		atomic.AddUint32(&mach.counters.Unplugs, 1)
+	}
+}
+
+// clearError forgets the error from the interface's most recent
+// commit, once the cause has been fixed. Returns false if there was
+// no error to clear.
+func (mach *IntfMachine) clearError() bool {
+	res := mach.lastResult()
+	if res == nil || res.err == nil {
+		return false
+	}
+	mach.lastApply.Store(&applyResult{completed: res.completed, txn: res.txn})
+	return true
+}
+
+// lastCommitOutput returns the output of the commit actions of the
+// interface's most recent successful commit, and false if none has
+// succeeded.
+func (mach *IntfMachine) lastCommitOutput() (string, bool) {
+	out, ok := mach.lastOutput.Load().(string)
+	return out, ok
+}
+
+// lastResult returns the result of the interface's most recent commit,
+// nil if none has completed.
+func (mach *IntfMachine) lastResult() *applyResult {
+	res, _ := mach.lastApply.Load().(*applyResult)
+	return res
 }
 
 func (mach *IntfMachine) applyUnplugged(cfg interface{}) State {
-	fmt.Println("Staging new configuration for interface", mach.ifname)
+	mach.log("Staging new configuration")
 	//swap candidate
 	config := cfg.(*data.Node)
 	mach.candidate.Store(config)
@@ -210,20 +593,20 @@ func (mach *IntfMachine) applyUnplugged(cfg interface{}) State {
 }
 
 func (mach *IntfMachine) resetUnplugged(cfg interface{}) State {
-	fmt.Println("Removing configuration for interface", mach.ifname)
+	mach.log("Removing configuration")
 	config := cfg.(*data.Node)
 	mach.candidate.Store(config)
 	return unplugged
 }
 
 func (mach *IntfMachine) apply(cfg interface{}) State {
-	fmt.Println("Applying new configuration for interface", mach.ifname)
+	mach.log("Applying new configuration")
 	config := cfg.(*data.Node)
 	return mach.applyconfig(config)
 }
 
 func (mach *IntfMachine) unapply(cfg interface{}) State {
-	fmt.Println("Unapplying configuration for interface", mach.ifname)
+	mach.log("Unapplying configuration")
 	config := cfg.(*data.Node)
 	return mach.applyconfig(config)
 }
@@ -234,92 +617,271 @@ func (mach *IntfMachine) applyconfig(candidate *data.Node) State {
 
 	candidate = mach.candidate.Load()
 	running := mach.running.Load()
+	txn := mach.candidateTxn
 
 	//start commit actions
-	go func() {
-		changes := applyIntf(mach.ifname, candidate, running)
-		mach.running.Store(candidate)
-		if changes {
-			mach.notifyConfigUpdated()
+	mach.startCommit(func() func() {
+		started := time.Now()
+		changes, output, err := applyIntf(
+			mach.ifname, candidate, running, mach.current.Load())
+		return func() {
+			mach.commitNotStarted = !changes && err != nil
+			if mach.commitNotStarted {
+				// nothing was committed, so running is unchanged
+				mach.recordApply(started, output, err, txn)
+				return
+			}
+			mach.running.Store(candidate)
+			if changes {
+				mach.recordApply(started, output, err, txn)
+				mach.notifyConfigUpdated(txn)
+			}
 		}
+	})
+	return applying
+}
 
-		mach.send(&message{typ: done, data: nil})
-	}()
+// reconcileconfig re-runs the commit actions for the running
+// configuration as if none of it had been applied, re-asserting
+// ifmgrd's view on a dataplane that has drifted from it.
+func (mach *IntfMachine) reconcileconfig(_ interface{}) State {
+	mach.log("Reconciling configuration")
+	running := mach.running.Load()
+	mach.startCommit(func() func() {
+		started := time.Now()
+		changes, output, err := applyIntf(
+			mach.ifname, running, nil, mach.current.Load())
+		return func() {
+			mach.commitNotStarted = !changes && err != nil
+			if changes || err != nil {
+				mach.recordApply(started, output, err, "")
+			}
+		}
+	})
 	return applying
 }
 
 func (mach *IntfMachine) unapplyconfig(newState State) State {
+	running := mach.running.Load()
 	//start commit actions
-	go func() {
+	mach.startCommit(func() func() {
+		started := time.Now()
 		// clear up any running configuration
-		changes := applyIntf(mach.ifname, nil, mach.running.Load())
-		mach.running.Store(nil)
-		if changes {
-			mach.notifyConfigUpdated()
+		changes, output, err := applyIntf(
+			mach.ifname, nil, running, mach.current.Load())
+		return func() {
+			mach.commitNotStarted = !changes && err != nil
+			if mach.commitNotStarted {
+				// nothing was committed, so running is unchanged
+				mach.recordApply(started, output, err, "")
+				return
+			}
+			mach.running.Store(nil)
+			if changes {
+				mach.recordApply(started, output, err, "")
+				mach.notifyConfigUpdated("")
+			}
 		}
+	})
+	return newState
+}
+
+// commitDone is the data of done and stuck messages. gen identifies
+// the commit, and complete, if set, records its results on the
+// machine's goroutine.
+type commitDone struct {
+	gen      uint64
+	complete func()
+}
 
-		mach.send(&message{typ: done, data: nil})
+// startCommit runs commit in the background. The machine is sent done
+// when it completes, or stuck if it is still running after the apply
+// timeout. commit must not change the machine; it returns a function
+// recording its results, which is run with done unless the commit has
+// been abandoned, so a late commit can't overwrite a newer one's.
+//
+// A panic in commit is logged and recorded as the commit's error, as
+// one in the commit pool is, so the machine still leaves applying.
+func (mach *IntfMachine) startCommit(commit func() func()) {
+	mach.lastCommit = time.Now()
+	mach.commitGen++
+	gen := mach.commitGen
+	started := mach.lastCommit
+	target, txn := mach.candidate.Load(), mach.candidateTxn
+	if mach.cfg.ApplyTimeout > 0 {
+		mach.watchdog = time.AfterFunc(mach.cfg.ApplyTimeout, func() {
+			mach.send(&message{typ: stuck, data: &commitDone{gen: gen}})
+		})
+	}
+	go func() {
+		var complete func()
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Fprintf(os.Stderr, "Commit for %s panicked: %v\n%s",
+					mach.ifname, r, debug.Stack())
+				metrics.Inc("commit-panics")
+				complete = mach.commitPanicked(started, target, txn,
+					fmt.Errorf("Commit panicked: %v", r))
+			}
+			mach.send(&message{
+				typ:  done,
+				data: &commitDone{gen: gen, complete: complete},
+			})
+		}()
+		complete = commit()
 	}()
-	return newState
+}
+
+// commitPanicked returns the completion of a commit that panicked. The
+// error is recorded and the commit treated as having applied target,
+// or removed the configuration if the machine is unapplying, so a
+// commit that panics is not retried.
+func (mach *IntfMachine) commitPanicked(
+	started time.Time,
+	target *data.Node,
+	txn string,
+	err error,
+) func() {
+	return func() {
+		mach.commitNotStarted = false
+		if mach.curState != applying {
+			target, txn = nil, ""
+		}
+		mach.running.Store(target)
+		mach.recordApply(started, "", err, txn)
+	}
+}
+
+// commitRetryInterval is the least time between retries of a commit
+// that could not be started.
+var commitRetryInterval = time.Second
+
+// commitDelay returns how long to wait before starting another commit
+// so that commits are no more frequent than the minimum interval, or
+// the retry interval after a commit could not be started.
+func (mach *IntfMachine) commitDelay() time.Duration {
+	interval := mach.cfg.MinCommitInterval
+	if mach.commitNotStarted && interval < commitRetryInterval {
+		interval = commitRetryInterval
+	}
+	if interval <= 0 {
+		return 0
+	}
+	return interval - time.Since(mach.lastCommit)
+}
+
+// stuckCommit abandons a commit that failed to complete in time. The
+// machine settles as if the commit had finished, without starting
+// another; any later done from the abandoned commit is ignored.
+func (mach *IntfMachine) stuckCommit(_ interface{}) State {
+	mach.logError("Commit did not complete within",
+		mach.cfg.ApplyTimeout, "- abandoning it")
+	metrics.Inc("apply-timeouts")
+	mach.notifyApplyTimeout(mach.curState)
+	mach.commitGen++
+	if mach.killReq || mach.curState == shuttingdown {
+		return mach.kill(nil)
+	}
+	if !mach.plugged {
+		return unplugged
+	}
+	return plugged
 }
 
 func (mach *IntfMachine) reset(cfg interface{}) State {
-	fmt.Println("Removing configuration for interface", mach.ifname)
+	mach.log("Removing configuration")
 	config := cfg.(*data.Node)
 	return mach.applyconfig(config)
 }
 
-func (mach *IntfMachine) plug(_ interface{}) State {
-	fmt.Println("Interface", mach.ifname, "became active")
-	mach.notifyInterfaceState("plugged")
+// logPlug logs a plug or unplug event with the reason sent with it,
+// returning the reason.
+func (mach *IntfMachine) logPlug(event string, data interface{}) string {
+	reason, _ := data.(string)
+	if reason == "" {
+		mach.log(event)
+	} else {
+		mach.log(event, "("+reason+")")
+	}
+	return reason
+}
+
+func (mach *IntfMachine) plug(data interface{}) State {
+	reason := mach.logPlug("Interface became active", data)
+	mach.notifyInterfaceState("plugged", reason)
 	mach.plugged = true
+	mach.everPlugged = true
+	mach.waitingHardware = false
+	if mach.neverPluggedTimer != nil {
+		mach.neverPluggedTimer.Stop()
+		mach.neverPluggedTimer = nil
+	}
 	return mach.applyconfig(mach.candidate.Load())
 }
 
-func (mach *IntfMachine) plugUnapplying(_ interface{}) State {
-	fmt.Println("Interface", mach.ifname, "became active")
-	mach.notifyInterfaceState("plugged")
+// waitForHardware reports an interface that has not been plugged
+// within the never-plugged timeout of being registered; its
+// configuration is staged but the hardware has not appeared.
+func (mach *IntfMachine) waitForHardware(_ interface{}) State {
+	mach.logError("Interface has not appeared within",
+		mach.cfg.NeverPluggedTimeout, "- waiting for hardware")
+	metrics.Inc("interfaces-never-plugged")
+	mach.waitingHardware = true
+	mach.notifyWaitingForHardware()
+	return unplugged
+}
+
+func (mach *IntfMachine) plugUnapplying(data interface{}) State {
+	reason := mach.logPlug("Interface became active", data)
+	mach.notifyInterfaceState("plugged", reason)
 	mach.plugged = true
 	return unapplying
 }
 
-func (mach *IntfMachine) unplug(_ interface{}) State {
-	fmt.Println("Interface", mach.ifname, "became inactive")
-	mach.notifyInterfaceState("unplugged")
+func (mach *IntfMachine) plugApplying(data interface{}) State {
+	// Plug seen after an unplug during the apply, the interface is
+	// back so there is nothing to cleanup once the apply completes
+	reason := mach.logPlug("Interface became active during apply", data)
+	mach.notifyInterfaceState("plugged", reason)
+	mach.plugged = true
+	return applying
+}
+
+func (mach *IntfMachine) unplug(data interface{}) State {
+	reason := mach.logPlug("Interface became inactive", data)
+	mach.notifyInterfaceState("unplugged", reason)
 	mach.plugged = false
 	// Cleanup the existing config
 	return mach.unapplyconfig(unapplying)
 }
 
-func (mach *IntfMachine) unplugApplying(_ interface{}) State {
+func (mach *IntfMachine) unplugApplying(data interface{}) State {
 	// Note that interface is unplugged, so that cleanup
 	// can happen once apply is complete
-	fmt.Println("Interface", mach.ifname, "became inactive during apply")
-	mach.notifyInterfaceState("unplugged")
+	reason := mach.logPlug("Interface became inactive during apply", data)
+	mach.notifyInterfaceState("unplugged", reason)
 	mach.plugged = false
 	return applying
 }
 
-func (mach *IntfMachine) unplugUnapplying(_ interface{}) State {
+func (mach *IntfMachine) unplugUnapplying(data interface{}) State {
 	// Unplug seen while cleaning up a previous unplug.
 	// Interface like flip-flopping
-	fmt.Println("Interface", mach.ifname, "became inactive during unapply")
-	mach.notifyInterfaceState("unplugged")
+	reason := mach.logPlug("Interface became inactive during unapply", data)
+	mach.notifyInterfaceState("unplugged", reason)
 	mach.plugged = false
 	return unapplying
 }
 
 func (mach *IntfMachine) resetApplying(cfg interface{}) State {
-	fmt.Println("Removing configuration for interface", mach.ifname,
-		"during previous application")
+	mach.log("Removing configuration during previous application")
 	config := cfg.(*data.Node)
 	mach.candidate.Store(config)
 	return applying
 }
 
 func (mach *IntfMachine) resetUnapplying(cfg interface{}) State {
-	fmt.Println("Removing configuration for interface", mach.ifname,
-		"during previous application")
+	mach.log("Removing configuration during previous application")
 	config := cfg.(*data.Node)
 	mach.candidate.Store(config)
 	return unapplying
@@ -327,8 +889,7 @@ func (mach *IntfMachine) resetUnapplying(cfg interface{}) State {
 
 func (mach *IntfMachine) swapApplying(cfg interface{}) State {
 	//coalesce the changes that occur while we are running scripts.
-	fmt.Println("Staging new configuration for interface", mach.ifname,
-		"during previous application")
+	mach.log("Staging new configuration during previous application")
 	config := cfg.(*data.Node)
 	//swap candidate
 	mach.candidate.Store(config)
@@ -337,8 +898,7 @@ func (mach *IntfMachine) swapApplying(cfg interface{}) State {
 
 func (mach *IntfMachine) swapUnapplying(cfg interface{}) State {
 	// Simply update the candidate
-	fmt.Println("Staging new configuration for interface", mach.ifname,
-		"during unapply")
+	mach.log("Staging new configuration during unapply")
 	config := cfg.(*data.Node)
 	//swap candidate
 	mach.candidate.Store(config)
@@ -356,19 +916,28 @@ func (mach *IntfMachine) doneApplying(_ interface{}) State {
 	candidate := mach.candidate.Load()
 	running := mach.running.Load()
 	if running != candidate {
-		fmt.Println("Configuration for interface", mach.ifname,
-			"changed while previous application was working;",
-			"applying new changeset.")
+		if wait := mach.commitDelay(); wait > 0 {
+			mach.log("Configuration changed while previous",
+				"application was working; deferring new changeset for",
+				wait)
+			gen := mach.commitGen
+			time.AfterFunc(wait, func() {
+				mach.send(&message{typ: done, data: &commitDone{gen: gen}})
+			})
+			return applying
+		}
+		mach.log("Configuration changed while previous application",
+			"was working; applying new changeset.")
 		//loop so we apply any coalesced updates we may have missed while
 		//running previous transaction
 		return mach.applyconfig(candidate)
 	}
-	fmt.Println("Configuration for interface", mach.ifname, "completed")
+	mach.log("Configuration completed")
 	return plugged
 }
 
 func (mach *IntfMachine) doneUnapplying(_ interface{}) State {
-	fmt.Println("Unapply for interface", mach.ifname, "completed")
+	mach.log("Unapply completed")
 	if mach.killReq {
 		return mach.unapplyconfig(shuttingdown)
 	}
@@ -379,28 +948,33 @@ func (mach *IntfMachine) doneUnapplying(_ interface{}) State {
 }
 
 func (mach *IntfMachine) kill(_ interface{}) State {
-	fmt.Println("Stopping interface manager for", mach.ifname)
+	mach.log("Stopping interface manager")
+	// Sessions created for the interface must not outlive its machine
+	sessionmgr.DeleteInterface(mach.ifname)
+	mach.notifyUnmanaged()
 	return shutdown
 }
 
 func (mach *IntfMachine) killPlugged(_ interface{}) State {
-	fmt.Println("Stopping interface manager for", mach.ifname)
+	mach.log("Stopping interface manager")
 	return mach.unapplyconfig(shuttingdown)
 }
 
 func (mach *IntfMachine) killApplying(_ interface{}) State {
-	fmt.Println("Stopping interface manager for", mach.ifname)
+	mach.log("Stopping interface manager")
 	mach.killReq = true
 	return applying
 }
 
 func (mach *IntfMachine) killUnapplying(_ interface{}) State {
-	fmt.Println("Stopping interface manager for", mach.ifname)
+	mach.log("Stopping interface manager")
 	mach.killReq = true
 	return unapplying
 }
 
 func (mach *IntfMachine) send(msg *message) bool {
+	atomic.AddInt32(&mach.pendingSends, 1)
+	defer atomic.AddInt32(&mach.pendingSends, -1)
 	select {
 	case mach.messages <- msg:
 		return true
@@ -409,20 +983,137 @@ func (mach *IntfMachine) send(msg *message) bool {
 	}
 }
 
+// sendWithin sends msg unless the machine has not received it after
+// timeout. Returns whether msg was sent and whether the send timed out;
+// neither if the machine has shutdown.
+func (mach *IntfMachine) sendWithin(
+	msg *message,
+	timeout time.Duration,
+) (sent, timedOut bool) {
+	atomic.AddInt32(&mach.pendingSends, 1)
+	defer atomic.AddInt32(&mach.pendingSends, -1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case mach.messages <- msg:
+		return true, false
+	case <-mach.done:
+		return false, false
+	case <-timer.C:
+		return false, true
+	}
+}
+
+// queueLatest queues a configuration message to be delivered in the
+// background, replacing any queued message it supersedes. At most one
+// message waits in the queue and one is being sent, however many
+// configurations arrive while the machine is busy, and the machine
+// always receives the latest.
+func (mach *IntfMachine) queueLatest(msg *message) {
+	mach.backlogMu.Lock()
+	defer mach.backlogMu.Unlock()
+	if mach.backlog != nil {
+		fmt.Fprintln(os.Stderr, "Interface manager for", mach.ifname,
+			"dropping superseded", mach.backlog.typ)
+		metrics.Inc("applies-dropped")
+	}
+	mach.backlog = msg
+	if !mach.draining {
+		mach.draining = true
+		go mach.drainBacklog()
+	}
+}
+
+// backlogged reports whether messages are waiting to be delivered in
+// the background, so later ones must queue behind them.
+func (mach *IntfMachine) backlogged() bool {
+	mach.backlogMu.Lock()
+	defer mach.backlogMu.Unlock()
+	return mach.draining
+}
+
+func (mach *IntfMachine) drainBacklog() {
+	for {
+		mach.backlogMu.Lock()
+		msg := mach.backlog
+		mach.backlog = nil
+		if msg == nil {
+			mach.draining = false
+			mach.backlogMu.Unlock()
+			return
+		}
+		mach.backlogMu.Unlock()
+		mach.post(msg)
+	}
+}
+
+// post sends msg, logging it if the machine has shutdown and the
+// message is dropped.
+func (mach *IntfMachine) post(msg *message) {
+	if !mach.send(msg) {
+		// the machine has stopped, so its state may be read here
+		mach.logError("Interface manager has stopped, dropping", msg.typ)
+		metrics.Inc("messages-dropped")
+	}
+}
+
 func (mach *IntfMachine) Apply(cfg *data.Node) {
-	mach.send(&message{typ: apply, data: cfg})
+	mach.ApplyTxn(cfg, "")
+}
+
+// ApplyTxn applies configuration identified by the caller's
+// transaction id, which is reported once the configuration is applied.
+func (mach *IntfMachine) ApplyTxn(cfg *data.Node, txn string) {
+	mach.post(&message{typ: apply, data: cfg, received: time.Now(), txn: txn})
 }
 
 func (mach *IntfMachine) Reset(cfg *data.Node) {
-	mach.send(&message{typ: reset, data: cfg})
+	mach.ResetTxn(cfg, "")
+}
+
+func (mach *IntfMachine) ResetTxn(cfg *data.Node, txn string) {
+	mach.post(&message{typ: reset, data: cfg, received: time.Now(), txn: txn})
+}
+
+// ApplyLag returns how long the oldest configuration received by the
+// machine has been waiting to be applied.
+func (mach *IntfMachine) ApplyLag() time.Duration {
+	since := atomic.LoadInt64(&mach.pendingSince)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// QueueDepth returns the number of messages waiting to be received by
+// the machine. A depth that stays above zero indicates a machine stuck
+// processing or a flood of messages.
+func (mach *IntfMachine) QueueDepth() int {
+	return int(atomic.LoadInt32(&mach.pendingSends))
 }
 
 func (mach *IntfMachine) Plug() {
-	mach.send(&message{typ: plug, data: nil})
+	mach.PlugReason("")
+}
+
+// PlugReason plugs the interface, noting the reason or source of the
+// plug, such as udev, in the log and interface-state notification.
+func (mach *IntfMachine) PlugReason(reason string) {
+	mach.post(&message{typ: plug, data: reason})
 }
 
 func (mach *IntfMachine) Unplug() {
-	mach.send(&message{typ: unplug, data: nil})
+	mach.UnplugReason("")
+}
+
+// UnplugReason unplugs the interface, noting the reason or source of
+// the unplug in the log and interface-state notification.
+func (mach *IntfMachine) UnplugReason(reason string) {
+	mach.post(&message{typ: unplug, data: reason})
+}
+
+func (mach *IntfMachine) Reconcile() {
+	mach.post(&message{typ: reconcile, data: nil})
 }
 
 func (mach *IntfMachine) Kill() {
@@ -433,62 +1124,266 @@ func (mach *IntfMachine) IsShutdown() bool {
 	return !mach.send(&message{typ: isShutdown, data: nil})
 }
 
+// inspect runs fn on the machine's goroutine so that it may safely
+// read the machine's state. Returns false if the machine has shutdown.
+func (mach *IntfMachine) inspect(fn func(*IntfMachine)) bool {
+	replied := make(chan struct{})
+	sent := mach.send(&message{typ: query, data: func(m *IntfMachine) {
+		fn(m)
+		close(replied)
+	}})
+	if !sent {
+		return false
+	}
+	<-replied
+	return true
+}
+
+func (mach *IntfMachine) IsPlugged() bool {
+	var plugged bool
+	mach.inspect(func(m *IntfMachine) {
+		plugged = m.plugged
+	})
+	return plugged
+}
+
+// converged reports whether the machine has applied its candidate
+// configuration, or is unplugged with nothing to apply it to.
+func (mach *IntfMachine) converged() bool {
+	converged := true
+	mach.inspect(func(m *IntfMachine) {
+		switch m.curState {
+		case unplugged:
+		case plugged:
+			converged = m.candidate.Load() == m.running.Load()
+		default:
+			converged = false
+		}
+	})
+	return converged
+}
+
+// eventCounters returns the interface's counters. Returns false if the
+// machine has shutdown.
+func (mach *IntfMachine) eventCounters() (*InterfaceCounters, bool) {
+	counters := &InterfaceCounters{}
+	ok := mach.inspect(func(m *IntfMachine) {
+		c := &m.counters
+		counters.Applies = atomic.LoadUint32(&c.Applies)
+		counters.Resets = atomic.LoadUint32(&c.Resets)
+		counters.Plugs = atomic.LoadUint32(&c.Plugs)
+		counters.Unplugs = atomic.LoadUint32(&c.Unplugs)
+		counters.CommitFailures = atomic.LoadUint32(&c.CommitFailures)
+	})
+	return counters, ok
+}
+
+// TimeInState returns the machine's current state and how long it has
+// been in it. Returns false if the machine has shutdown.
+func (mach *IntfMachine) TimeInState() (State, time.Duration, bool) {
+	var state State
+	var since time.Time
+	ok := mach.inspect(func(m *IntfMachine) {
+		state = m.curState
+		since = m.stateSince
+	})
+	return state, time.Since(since), ok
+}
+
 func NewIntfMachine(ifname string) *IntfMachine {
+	return newIntfMachine(ifname, &Config{}, data.NewAtomicNode(nil))
+}
+
+func newIntfMachine(
+	ifname string,
+	cfg *Config,
+	current *data.AtomicNode,
+) *IntfMachine {
 	mach := &IntfMachine{
-		ifname:    ifname,
-		curState:  unplugged,
-		messages:  make(chan *message),
-		done:      make(chan struct{}),
-		candidate: data.NewAtomicNode(nil),
-		running:   data.NewAtomicNode(nil),
-		transitionTable: map[State]map[messageType]TransFn{
-			unplugged: {
-				apply: (*IntfMachine).applyUnplugged,
-				reset: (*IntfMachine).resetUnplugged,
-				plug:  (*IntfMachine).plug,
-				kill:  (*IntfMachine).kill,
-			},
-			plugged: {
-				apply:  (*IntfMachine).apply,
-				reset:  (*IntfMachine).reset,
-				unplug: (*IntfMachine).unplug,
-				kill:   (*IntfMachine).killPlugged,
-			},
-			applying: {
-				apply:  (*IntfMachine).swapApplying,
-				reset:  (*IntfMachine).resetApplying,
-				unplug: (*IntfMachine).unplugApplying,
-				done:   (*IntfMachine).doneApplying,
-				kill:   (*IntfMachine).killApplying,
-			},
-			unapplying: {
-				apply:  (*IntfMachine).swapUnapplying,
-				reset:  (*IntfMachine).resetUnapplying,
-				plug:   (*IntfMachine).plugUnapplying,
-				unplug: (*IntfMachine).unplugUnapplying,
-				done:   (*IntfMachine).doneUnapplying,
-				kill:   (*IntfMachine).killUnapplying,
-			},
-			shuttingdown: {
-				done: (*IntfMachine).kill,
-			},
-		},
+		cfg:             cfg,
+		current:         current,
+		ifname:          ifname,
+		curState:        unplugged,
+		messages:        make(chan *message),
+		done:            make(chan struct{}),
+		candidate:       data.NewAtomicNode(nil),
+		running:         data.NewAtomicNode(nil),
+		transitionTable: newTransitionTable(),
+		stateSince:      time.Now(),
+	}
+	if cfg.NeverPluggedTimeout > 0 {
+		mach.neverPluggedTimer = time.AfterFunc(cfg.NeverPluggedTimeout,
+			func() { mach.send(&message{typ: neverPlugged}) })
 	}
 	go mach.run()
 	return mach
 }
 
+func newTransitionTable() map[State]map[messageType]transition {
+	return map[State]map[messageType]transition{
+		unplugged: {
+			apply: {(*IntfMachine).applyUnplugged,
+				[]State{unplugged}},
+			reset: {(*IntfMachine).resetUnplugged,
+				[]State{unplugged}},
+			plug: {(*IntfMachine).plug,
+				[]State{applying}},
+			neverPlugged: {(*IntfMachine).waitForHardware,
+				[]State{unplugged}},
+			kill: {(*IntfMachine).kill,
+				[]State{shutdown}},
+		},
+		plugged: {
+			apply: {(*IntfMachine).apply,
+				[]State{applying}},
+			reset: {(*IntfMachine).reset,
+				[]State{applying}},
+			unplug: {(*IntfMachine).unplug,
+				[]State{unapplying}},
+			reconcile: {(*IntfMachine).reconcileconfig,
+				[]State{applying}},
+			kill: {(*IntfMachine).killPlugged,
+				[]State{shuttingdown}},
+		},
+		applying: {
+			apply: {(*IntfMachine).swapApplying,
+				[]State{applying}},
+			reset: {(*IntfMachine).resetApplying,
+				[]State{applying}},
+			plug: {(*IntfMachine).plugApplying,
+				[]State{applying}},
+			unplug: {(*IntfMachine).unplugApplying,
+				[]State{applying}},
+			done: {(*IntfMachine).doneApplying,
+				[]State{plugged, applying, unapplying, shuttingdown}},
+			stuck: {(*IntfMachine).stuckCommit,
+				[]State{plugged, unplugged, shutdown}},
+			kill: {(*IntfMachine).killApplying,
+				[]State{applying}},
+		},
+		unapplying: {
+			apply: {(*IntfMachine).swapUnapplying,
+				[]State{unapplying}},
+			reset: {(*IntfMachine).resetUnapplying,
+				[]State{unapplying}},
+			plug: {(*IntfMachine).plugUnapplying,
+				[]State{unapplying}},
+			unplug: {(*IntfMachine).unplugUnapplying,
+				[]State{unapplying}},
+			done: {(*IntfMachine).doneUnapplying,
+				[]State{unplugged, applying, shuttingdown}},
+			stuck: {(*IntfMachine).stuckCommit,
+				[]State{plugged, unplugged, shutdown}},
+			kill: {(*IntfMachine).killUnapplying,
+				[]State{unapplying}},
+		},
+		shuttingdown: {
+			done: {(*IntfMachine).kill,
+				[]State{shutdown}},
+			stuck: {(*IntfMachine).stuckCommit,
+				[]State{shutdown}},
+		},
+	}
+}
+
+type StateTransitions struct {
+	State  string   `json:"state"`
+	Events []string `json:"events"`
+}
+
+// transitions lists the events handled in each state of the machine,
+// in state order.
+func transitions() []*StateTransitions {
+	table := newTransitionTable()
+	states := make([]State, 0, len(table))
+	for state := range table {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+
+	out := make([]*StateTransitions, 0, len(states))
+	for _, state := range states {
+		typs := make([]messageType, 0, len(table[state]))
+		for typ := range table[state] {
+			typs = append(typs, typ)
+		}
+		sort.Slice(typs, func(i, j int) bool { return typs[i] < typs[j] })
+		st := &StateTransitions{State: state.String()}
+		for _, typ := range typs {
+			st.Events = append(st.Events, typ.String())
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
 func (mach *IntfMachine) run() {
 	state := mach.curState
 	for {
 		msg := <-mach.messages
-		trans := mach.transitionTable[state][msg.typ]
-		if trans == nil {
-			fmt.Println("No transition for", msg.typ, "in state", state)
+		if msg.typ == query {
+			msg.data.(func(*IntfMachine))(mach)
+			continue
+		}
+		if msg.typ == neverPlugged && mach.everPlugged {
+			// the timer fired as the first plug stopped it
 			continue
 		}
-		state = trans(mach, msg.data)
+		if msg.typ == done || msg.typ == stuck {
+			cd := msg.data.(*commitDone)
+			if cd.gen != mach.commitGen {
+				mach.log("Ignoring", msg.typ,
+					"from an abandoned commit")
+				continue
+			}
+			if mach.watchdog != nil {
+				mach.watchdog.Stop()
+				mach.watchdog = nil
+			}
+			if cd.complete != nil {
+				cd.complete()
+			}
+		}
+		trans, handled := mach.transitionTable[state][msg.typ]
+		if !handled {
+			mach.log("No transition for", msg.typ)
+			continue
+		}
+		if msg.seq != 0 {
+			if msg.seq < mach.dispatchSeq {
+				// overtaken while waiting to be delivered
+				mach.log("Ignoring superseded", msg.typ)
+				continue
+			}
+			mach.dispatchSeq = msg.seq
+		}
+		if msg.typ == apply || msg.typ == reset {
+			atomic.CompareAndSwapInt64(&mach.pendingSince,
+				0, msg.received.UnixNano())
+			mach.candidateTxn = msg.txn
+		}
+		mach.countEvent(msg.typ)
+		from := state
+		state = trans.handle(mach, msg.data)
 		mach.curState = state
+		if !trans.leadsTo(state) {
+			// the transition table is out of date
+			mach.logError("Unlisted transition from", from, "to",
+				state, "on", msg.typ)
+			metrics.Inc("transitions-unlisted")
+		}
+		if state != from {
+			mach.stateSince = time.Now()
+			events.Publish("transition", mach.ifname, &Transition{
+				Event: msg.typ.String(),
+				From:  from.String(),
+				To:    state.String(),
+			})
+		}
+		switch state {
+		case plugged, unplugged, shutdown:
+			atomic.StoreInt64(&mach.pendingSince, 0)
+		}
 		if state == shutdown {
 			break
 		}
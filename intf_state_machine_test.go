@@ -0,0 +1,870 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danos/config/data"
+	"github.com/danos/utils/exec"
+)
+
+type testNotification struct {
+	name   string
+	object interface{}
+}
+
+// Notifications emitted during the tests, oldest first
+var testNotifications struct {
+	sync.Mutex
+	sent []testNotification
+}
+
+func init() {
+	// Tests don't have a VCI bus to emit to
+	emitNotification = func(_, name string, object interface{}) error {
+		testNotifications.Lock()
+		defer testNotifications.Unlock()
+		testNotifications.sent = append(testNotifications.sent,
+			testNotification{name: name, object: object})
+		return nil
+	}
+}
+
+// Wait for the interface-state notifications emitted for an interface
+// to match want.
+func testWaitInterfaceStates(t *testing.T, ifname string, want ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var states []string
+		testNotifications.Lock()
+		for _, n := range testNotifications.sent {
+			s, ok := n.object.(*InterfaceState)
+			if ok && s.Interface.Name == ifname {
+				states = append(states, s.Interface.State)
+			}
+		}
+		testNotifications.Unlock()
+		if reflect.DeepEqual(states, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Interface %s notified states %v, expected %v",
+				ifname, states, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Wait for a notification matching match to be emitted
+func testWaitNotified(t *testing.T, what string, match func(interface{}) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var notified bool
+		testNotifications.Lock()
+		for _, n := range testNotifications.sent {
+			if match(n.object) {
+				notified = true
+			}
+		}
+		testNotifications.Unlock()
+		if notified {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("No %s notification", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type testCommit struct {
+	intf      string
+	candidate *data.Node
+	running   *data.Node
+}
+
+// Record commits instead of running commit actions
+type testCommitRecorder struct {
+	sync.Mutex
+	commits []testCommit
+}
+
+func newTestCommitRecorder(t *testing.T) *testCommitRecorder {
+	rec := &testCommitRecorder{}
+	orig := commitIntf
+	commitIntf = func(name string, committer *Committer) (bool, error) {
+		rec.Lock()
+		defer rec.Unlock()
+		rec.commits = append(rec.commits, testCommit{
+			intf:      name,
+			candidate: committer.Candidate(),
+			running:   committer.Running(),
+		})
+		return true, nil
+	}
+	t.Cleanup(func() { commitIntf = orig })
+	return rec
+}
+
+func (rec *testCommitRecorder) Commits() []testCommit {
+	rec.Lock()
+	defer rec.Unlock()
+	return append([]testCommit(nil), rec.commits...)
+}
+
+// Wait for the machine to reach the given state
+func testWaitState(t *testing.T, mach *IntfMachine, want State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var state State
+		if !mach.inspect(func(m *IntfMachine) {
+			state = m.curState
+		}) {
+			t.Fatalf("Interface %s machine has shutdown", mach.ifname)
+		}
+		if state == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Interface %s in state %s, expected %s",
+				mach.ifname, state, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Unregister the interface and wait for its machine to shutdown, so
+// that its final commit is complete before the test is torn down.
+func testUnregister(t *testing.T, mgr *IntfManager, name string) {
+	mach := mgr.interfaces[name]
+	mgr.Unregister(name)
+	select {
+	case <-mach.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Interface %s machine did not shutdown", name)
+	}
+}
+
+// Check the tree contains only 'interfaces <typ> <name>'
+func checkCommitRoot(t *testing.T, tree *data.Node, typ, name string) {
+	if tree == nil {
+		t.Fatalf("Commit for %s has no configuration", name)
+	}
+	if names := tree.ChildNames(); len(names) != 1 || names[0] != "interfaces" {
+		t.Fatalf("Commit for %s has top level nodes %v", name, names)
+	}
+	types := tree.Child("interfaces").ChildNames()
+	if len(types) != 1 || types[0] != typ {
+		t.Fatalf("Commit for %s has interface types %v", name, types)
+	}
+	intfs := tree.Child("interfaces").Child(typ).ChildNames()
+	if len(intfs) != 1 || intfs[0] != name {
+		t.Fatalf("Commit for %s has interfaces %v", name, intfs)
+	}
+}
+
+func TestApplyScopesInterfaceSubtrees(t *testing.T) {
+	rec := newTestCommitRecorder(t)
+	intfs := []testIntf{
+		{"dataplane", "tst0s1", "first dataplane"},
+		{"dataplane", "tst0s2", "second dataplane"},
+		{"loopback", "tstlo1", "loopback"},
+	}
+
+	mgr := NewIntfManager()
+	for _, intf := range intfs {
+		mgr.Register(intf.name)
+		defer testUnregister(t, mgr, intf.name)
+	}
+	mgr.Apply(testConfig(intfs...))
+	for _, intf := range intfs {
+		mgr.Plug(intf.name)
+	}
+	for _, intf := range intfs {
+		testWaitState(t, mgr.interfaces[intf.name], plugged)
+	}
+
+	commits := rec.Commits()
+	if len(commits) != len(intfs) {
+		t.Fatalf("Expected %d commits, got %d", len(intfs), len(commits))
+	}
+	for _, c := range commits {
+		var typ string
+		for _, intf := range intfs {
+			if intf.name == c.intf {
+				typ = intf.typ
+			}
+		}
+		if typ == "" {
+			t.Fatalf("Commit for unexpected interface %s", c.intf)
+		}
+		checkCommitRoot(t, c.candidate, typ, c.intf)
+		desc := c.candidate.Descendant(
+			[]string{"interfaces", typ, c.intf, "description"})
+		for _, intf := range intfs {
+			if intf.name == c.intf && desc.Child(intf.description) == nil {
+				t.Fatalf("Commit for %s has wrong description %v",
+					c.intf, desc.ChildNames())
+			}
+		}
+		if c.running != nil {
+			t.Fatalf("Initial commit for %s has running config", c.intf)
+		}
+	}
+}
+
+func TestFindCommitRootMissingInterface(t *testing.T) {
+	config := testConfig(testIntf{"dataplane", "tst0s1", "present"})
+	if findCommitRoot("tst0s2", config) != nil {
+		t.Fatal("Found commit root for unconfigured interface")
+	}
+}
+
+func TestRegisterBeforeApply(t *testing.T) {
+	rec := newTestCommitRecorder(t)
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mach := mgr.interfaces["tst0s1"]
+	if candidate := testCandidate(t, mach); candidate != nil {
+		t.Fatalf("Candidate staged before any config was applied")
+	}
+	mgr.Plug("tst0s1")
+	testWaitState(t, mach, plugged)
+	if commits := rec.Commits(); len(commits) != 0 {
+		t.Fatalf("Committed %d times without config", len(commits))
+	}
+
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "late"}))
+	testWaitState(t, mach, plugged)
+	if commits := rec.Commits(); len(commits) != 1 {
+		t.Fatalf("Committed %d times, expected once", len(commits))
+	}
+}
+
+func TestRegisterPresentInterfaceNotifiesPlugged(t *testing.T) {
+	newTestCommitRecorder(t)
+	// the loopback interface is present in every network namespace
+	const present = "lo"
+	const absent = "tst0s9"
+
+	mgr := NewIntfManager()
+	mgr.Apply(testConfig(testIntf{"loopback", present, "loopback"}))
+	mgr.Register(present)
+	defer testUnregister(t, mgr, present)
+	mgr.Register(absent)
+	defer testUnregister(t, mgr, absent)
+
+	testWaitInterfaceStates(t, present, "plugged")
+	testWaitInterfaceStates(t, absent, "unplugged")
+}
+
+func TestReconcileReappliesRunningConfig(t *testing.T) {
+	rec := newTestCommitRecorder(t)
+	intf := testIntf{"dataplane", "tst0s1", "reconciled"}
+
+	mgr := NewIntfManager()
+	mgr.Register(intf.name)
+	defer testUnregister(t, mgr, intf.name)
+	mgr.Apply(testConfig(intf))
+	mgr.Plug(intf.name)
+	mach := mgr.interfaces[intf.name]
+	testWaitState(t, mach, plugged)
+
+	if !mgr.Reconcile(intf.name) {
+		t.Fatal("Reconcile of managed interface failed")
+	}
+	testWaitState(t, mach, plugged)
+
+	commits := rec.Commits()
+	if len(commits) != 2 {
+		t.Fatalf("Expected 2 commits, got %d", len(commits))
+	}
+	checkCommitRoot(t, commits[1].candidate, intf.typ, intf.name)
+	if commits[1].running != nil {
+		t.Fatal("Reconcile commit has running config")
+	}
+	if mgr.Reconcile("tst0s2") {
+		t.Fatal("Reconcile of unmanaged interface succeeded")
+	}
+}
+
+func TestMinCommitIntervalDefersNextCommit(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	var mu sync.Mutex
+	var started []time.Time
+	var candidates []*data.Node
+	orig := commitIntf
+	commitIntf = func(name string, committer *Committer) (bool, error) {
+		mu.Lock()
+		started = append(started, time.Now())
+		candidates = append(candidates, committer.Candidate())
+		mu.Unlock()
+		// keep the machine applying while further config arrives
+		time.Sleep(50 * time.Millisecond)
+		return true, nil
+	}
+	defer func() { commitIntf = orig }()
+
+	mgr := NewIntfManager()
+	mgr.configure(&Config{MinCommitInterval: interval})
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "first"}))
+	mgr.Plug("tst0s1")
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "second"}))
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "third"}))
+
+	time.Sleep(interval / 2)
+	testWaitState(t, mgr.interfaces["tst0s1"], plugged)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(started) != 2 {
+		t.Fatalf("Expected 2 commits, got %d", len(started))
+	}
+	if gap := started[1].Sub(started[0]); gap < interval {
+		t.Fatalf("Second commit started %s after the first", gap)
+	}
+	desc := candidates[1].Descendant(
+		[]string{"interfaces", "dataplane", "tst0s1", "description"})
+	if desc.Child("third") == nil {
+		t.Fatalf("Deferred commit has description %v", desc.ChildNames())
+	}
+}
+
+// Every state but shutdown must be able to reach it, either by
+// handling kill or, once shutting down, by its commit completing.
+func TestTransitionTableCanShutdown(t *testing.T) {
+	table := newTransitionTable()
+	for state := unplugged; state < shutdown; state++ {
+		trans, ok := table[state]
+		if !ok {
+			t.Fatalf("No transitions for state %s", state)
+		}
+		if state == shuttingdown {
+			if _, ok := trans[done]; !ok {
+				t.Fatalf("State %s does not handle %s", state, done)
+			}
+			continue
+		}
+		if _, ok := trans[kill]; !ok {
+			t.Fatalf("State %s does not handle %s", state, kill)
+		}
+	}
+	if _, ok := table[shutdown]; ok {
+		t.Fatalf("State %s has transitions", shutdown)
+	}
+}
+
+func TestTransitionsListsEventsInOrder(t *testing.T) {
+	out := transitions()
+	if len(out) != int(shutdown) {
+		t.Fatalf("Expected %d states, got %d", shutdown, len(out))
+	}
+	first := out[0]
+	if first.State != unplugged.String() {
+		t.Fatalf("First state is %s", first.State)
+	}
+	want := []string{"Apply", "Reset", "Plug", "Kill", "NeverPlugged"}
+	if !reflect.DeepEqual(first.Events, want) {
+		t.Fatalf("State %s events %v, expected %v",
+			first.State, first.Events, want)
+	}
+}
+
+func TestOperationalStateReportsLastError(t *testing.T) {
+	orig := commitIntf
+	commitIntf = func(name string, committer *Committer) (bool, error) {
+		return true, errors.New("commit action failed")
+	}
+	defer func() { commitIntf = orig }()
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	if state, _ := mgr.operationalState("tst0s1"); state.LastApply != "" {
+		t.Fatalf("Last apply %s reported before any commit", state.LastApply)
+	}
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "failing"}))
+	mgr.Plug("tst0s1")
+	testWaitState(t, mgr.interfaces["tst0s1"], plugged)
+
+	state, managed := mgr.operationalState("tst0s1")
+	if !managed {
+		t.Fatal("Interface not reported as managed")
+	}
+	if state.State != "plugged" || !state.Plugged {
+		t.Fatalf("Unexpected state %+v", state)
+	}
+	if state.LastApply == "" || state.LastError != "commit action failed" {
+		t.Fatalf("Last commit not reported: %+v", state)
+	}
+	if _, managed := mgr.operationalState("tst0s2"); managed {
+		t.Fatal("Unregistered interface reported as managed")
+	}
+
+	mgr.ClearError("tst0s1", false)
+	state, _ = mgr.operationalState("tst0s1")
+	if state.LastApply == "" || state.LastError != "" {
+		t.Fatalf("Last error not cleared: %+v", state)
+	}
+}
+
+func TestQueueDepthCountsWaitingMessages(t *testing.T) {
+	mach := NewIntfMachine("tst0s1")
+	defer mach.Kill()
+
+	// hold the machine busy so the next message has to wait
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	go mach.inspect(func(*IntfMachine) {
+		close(busy)
+		<-release
+	})
+	<-busy
+	go mach.Apply(testConfig(testIntf{"dataplane", "tst0s1", "queued"}))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mach.QueueDepth() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Queue depth %d, expected 1", mach.QueueDepth())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for mach.QueueDepth() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Queue depth %d, expected 0", mach.QueueDepth())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApplyAfterShutdownIsDropped(t *testing.T) {
+	mach := NewIntfMachine("tst0s1")
+	mach.Kill()
+	<-mach.done
+
+	before := metrics.Snapshot()["messages-dropped"]
+	mach.Apply(testConfig(testIntf{"dataplane", "tst0s1", "late"}))
+	if after := metrics.Snapshot()["messages-dropped"]; after != before+1 {
+		t.Fatalf("Dropped messages %d, expected %d", after, before+1)
+	}
+}
+
+func TestTimeInStateResetsOnTransition(t *testing.T) {
+	orig := commitIntf
+	commitIntf = func(string, *Committer) (bool, error) { return true, nil }
+	defer func() { commitIntf = orig }()
+
+	mach := NewIntfMachine("tst0s1")
+	defer func() {
+		mach.Kill()
+		<-mach.done
+	}()
+	time.Sleep(50 * time.Millisecond)
+	state, waited, ok := mach.TimeInState()
+	if !ok || state != unplugged || waited < 50*time.Millisecond {
+		t.Fatalf("In %s for %s, expected unplugged for at least 50ms",
+			state, waited)
+	}
+
+	mach.Apply(testConfig(testIntf{"dataplane", "tst0s1", "timed"}))
+	mach.Plug()
+	testWaitState(t, mach, plugged)
+	state, since, _ := mach.TimeInState()
+	if state != plugged || since >= waited {
+		t.Fatalf("In %s for %s, expected plugged for less than %s",
+			state, since, waited)
+	}
+}
+
+func TestPlugDuringApplyAfterUnplug(t *testing.T) {
+	release := make(chan struct{})
+	var commits int32
+	orig := commitIntf
+	commitIntf = func(string, *Committer) (bool, error) {
+		if atomic.AddInt32(&commits, 1) == 1 {
+			<-release
+		}
+		return true, nil
+	}
+	defer func() { commitIntf = orig }()
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mach := mgr.interfaces["tst0s1"]
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s1", "flapped"}))
+	mgr.Plug("tst0s1")
+	testWaitState(t, mach, applying)
+
+	mgr.Unplug("tst0s1")
+	mgr.Plug("tst0s1")
+	if !mach.IsPlugged() {
+		t.Fatal("Plug during apply was dropped")
+	}
+	close(release)
+	testWaitState(t, mach, plugged)
+	if n := atomic.LoadInt32(&commits); n != 1 {
+		t.Fatalf("Committed %d times, expected no unapply", n)
+	}
+}
+
+func TestApplyTxnIsReported(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.Register("tst0s1")
+	defer testUnregister(t, mgr, "tst0s1")
+	mgr.ApplyTxn(testConfig(testIntf{"dataplane", "tst0s1", "traced"}),
+		"commit-42")
+	mgr.Plug("tst0s1")
+	testWaitState(t, mgr.interfaces["tst0s1"], plugged)
+
+	state, _ := mgr.operationalState("tst0s1")
+	if state.LastTransaction != "commit-42" {
+		t.Fatalf("Last transaction %q, expected commit-42",
+			state.LastTransaction)
+	}
+	testWaitNotified(t, "configuration-updated for commit-42",
+		func(obj interface{}) bool {
+			cu, ok := obj.(*ConfigurationUpdated)
+			return ok && cu.Interface.Name == "tst0s1" &&
+				cu.Transaction == "commit-42"
+		})
+}
+
+func TestUnregisterNotifiesUnmanaged(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.Register("tst0s7")
+	testUnregister(t, mgr, "tst0s7")
+
+	testWaitNotified(t, "interface-unmanaged for tst0s7",
+		func(obj interface{}) bool {
+			u, ok := obj.(*InterfaceUnmanaged)
+			return ok && u.Interface.Name == "tst0s7"
+		})
+}
+
+func TestObserveDoesNotCommit(t *testing.T) {
+	orig := intfmgr.settings()
+	intfmgr.configure(&Config{Observe: true})
+	defer intfmgr.configure(orig)
+
+	before := metrics.Snapshot()["commits-observed"]
+	changed, err := commitIntf("tst0s1",
+		NewCommitter(data.New("root"), nil, SchemaTree.Load(), "observe"))
+	if !changed || err != nil {
+		t.Fatalf("Observed commit: changed %v, error %v", changed, err)
+	}
+	if after := metrics.Snapshot()["commits-observed"]; after != before+1 {
+		t.Fatalf("commits-observed %d, expected %d", after, before+1)
+	}
+}
+
+func TestNeverPluggedReportsWaitingForHardware(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.configure(&Config{NeverPluggedTimeout: 10 * time.Millisecond})
+	mgr.Register("tst0s9")
+	defer testUnregister(t, mgr, "tst0s9")
+
+	testWaitNotified(t, "waiting-for-hardware for tst0s9",
+		func(obj interface{}) bool {
+			w, ok := obj.(*WaitingForHardware)
+			return ok && w.Interface.Name == "tst0s9"
+		})
+	if state, _ := mgr.operationalState("tst0s9"); !state.WaitingForHardware {
+		t.Fatal("Interface not reported as waiting for hardware")
+	}
+
+	mgr.Plug("tst0s9")
+	testWaitState(t, mgr.interfaces["tst0s9"], plugged)
+	if state, _ := mgr.operationalState("tst0s9"); state.WaitingForHardware {
+		t.Fatal("Plugged interface still waiting for hardware")
+	}
+}
+
+// Plugging an interface stops it being reported as never plugged
+func TestPlugStopsNeverPluggedTimer(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.configure(&Config{NeverPluggedTimeout: 20 * time.Millisecond})
+	mgr.Register("tst0s19")
+	defer testUnregister(t, mgr, "tst0s19")
+	mach := mgr.interfaces["tst0s19"]
+	before := metrics.Snapshot()["interfaces-never-plugged"]
+
+	mgr.Plug("tst0s19")
+	testWaitState(t, mach, plugged)
+	var timer *time.Timer
+	mach.inspect(func(m *IntfMachine) { timer = m.neverPluggedTimer })
+	if timer != nil {
+		t.Fatal("Never-plugged timer still running once plugged")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if after := metrics.Snapshot()["interfaces-never-plugged"]; after != before {
+		t.Fatal("Plugged interface reported as never plugged")
+	}
+}
+
+func TestPlugReasonIsNotified(t *testing.T) {
+	newTestCommitRecorder(t)
+	mgr := NewIntfManager()
+	mgr.Register("tst0s10")
+	defer testUnregister(t, mgr, "tst0s10")
+
+	mgr.PlugReason("tst0s10", "udev")
+	testWaitNotified(t, "plugged by udev for tst0s10",
+		func(obj interface{}) bool {
+			s, ok := obj.(*InterfaceState)
+			return ok && s.Interface.Name == "tst0s10" &&
+				s.Interface.State == "plugged" &&
+				s.Interface.Reason == "udev"
+		})
+}
+
+// The output of a failed commit doesn't replace that of the last
+// successful one
+func TestLastOutputIsFromSuccessfulCommit(t *testing.T) {
+	var fail int32
+	orig := commitIntf
+	commitIntf = func(name string, committer *Committer) (bool, error) {
+		if atomic.LoadInt32(&fail) != 0 {
+			committer.output = "half done"
+			return true, errors.New("script failed")
+		}
+		committer.output = "configured " + name
+		return true, nil
+	}
+	t.Cleanup(func() { commitIntf = orig })
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s11")
+	defer testUnregister(t, mgr, "tst0s11")
+	mach := mgr.interfaces["tst0s11"]
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s11", "first"}))
+	mgr.Plug("tst0s11")
+	testWaitState(t, mach, plugged)
+	if out, _ := mgr.lastOutput("tst0s11"); out != "configured tst0s11" {
+		t.Fatalf("Last output %q after successful commit", out)
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s11", "second"}))
+	testWaitState(t, mach, plugged)
+	if out, _ := mgr.lastOutput("tst0s11"); out != "configured tst0s11" {
+		t.Fatalf("Last output %q after failed commit", out)
+	}
+}
+
+func TestInterfaceCountersCountEvents(t *testing.T) {
+	orig := commitIntf
+	commitIntf = func(name string, committer *Committer) (bool, error) {
+		return true, errors.New("script failed")
+	}
+	t.Cleanup(func() { commitIntf = orig })
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s12")
+	defer testUnregister(t, mgr, "tst0s12")
+	mach := mgr.interfaces["tst0s12"]
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s12", "first"}))
+	mgr.Plug("tst0s12")
+	testWaitState(t, mach, plugged)
+	mgr.Unplug("tst0s12")
+	testWaitState(t, mach, unplugged)
+
+	counters, managed := mgr.interfaceCounters("tst0s12")
+	if !managed {
+		t.Fatal("tst0s12 not managed")
+	}
+	expect := &InterfaceCounters{
+		Applies:        1,
+		Plugs:          1,
+		Unplugs:        1,
+		CommitFailures: 2,
+	}
+	if *counters != *expect {
+		t.Fatalf("Counters %+v, expected %+v", counters, expect)
+	}
+	if _, managed := mgr.interfaceCounters("tst0s99"); managed {
+		t.Fatal("Counters reported for an unmanaged interface")
+	}
+}
+
+func TestCommitOutputTruncates(t *testing.T) {
+	outs := []*exec.Output{
+		{Output: "first"},
+		{Output: ""},
+		{Output: "second é"},
+	}
+	if out := commitOutput(outs, 0); out != "first\nsecond é" {
+		t.Fatalf("Unlimited output %q", out)
+	}
+	if out := commitOutput(outs, 100); out != "first\nsecond é" {
+		t.Fatalf("Output within the limit %q", out)
+	}
+	// the limit falls within the two bytes of the last character
+	want := "first\nsecond \n[output truncated, 2 bytes dropped]"
+	if out := commitOutput(outs, 14); out != want {
+		t.Fatalf("Truncated output %q, expected %q", out, want)
+	}
+	want = "fir\n[output truncated, 12 bytes dropped]"
+	if out := commitOutput(outs, 3); out != want {
+		t.Fatalf("Truncated output %q, expected %q", out, want)
+	}
+}
+
+// A commit finishing after it has been abandoned must not overwrite
+// the results of the commits made since
+func TestAbandonedCommitIsIgnored(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	orig := commitIntf
+	commitIntf = func(name string, _ *Committer) (bool, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+			return true, errors.New("late failure")
+		}
+		return true, nil
+	}
+	t.Cleanup(func() { commitIntf = orig })
+
+	mgr := NewIntfManager()
+	mgr.configure(&Config{ApplyTimeout: 20 * time.Millisecond})
+	mgr.Register("tst0s13")
+	defer testUnregister(t, mgr, "tst0s13")
+	mach := mgr.interfaces["tst0s13"]
+	mgr.Plug("tst0s13")
+	testWaitState(t, mach, plugged)
+
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s13", "abandoned"}))
+	testWaitNotified(t, "apply timeout for tst0s13",
+		func(o interface{}) bool {
+			a, ok := o.(*ApplyTimeout)
+			return ok && a.Interface.Name == "tst0s13"
+		})
+	testWaitState(t, mach, plugged)
+	config := testConfig(testIntf{"dataplane", "tst0s13", "current"})
+	mgr.Apply(config)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("tst0s13 not committed after the timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	testWaitState(t, mach, plugged)
+
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+	testWaitState(t, mach, plugged)
+	if !treesEqual(mach.running.Load(), findCommitRoot("tst0s13", config)) {
+		t.Fatal("Abandoned commit overwrote the running config")
+	}
+	if res := mach.lastResult(); res == nil || res.err != nil {
+		t.Fatalf("Abandoned commit overwrote the last result %+v", res)
+	}
+}
+
+// ifmgrd's commit sessions don't count against the session limit, and
+// a commit that can't get a session leaves the running configuration
+// as it was
+func TestCommitSessionsNotLimited(t *testing.T) {
+	newTestCommitRecorder(t)
+	sessionmgr.setMax(1)
+	defer sessionmgr.setMax(0)
+	if _, err := sessionmgr.New("tst-client", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer sessionmgr.Delete("tst-client")
+	if _, err := sessionmgr.New("tst-client2", nil, nil, nil); err == nil {
+		sessionmgr.Delete("tst-client2")
+		t.Fatal("Client session beyond the limit was created")
+	}
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s17")
+	defer testUnregister(t, mgr, "tst0s17")
+	mach := mgr.interfaces["tst0s17"]
+	mgr.Plug("tst0s17")
+	testWaitState(t, mach, plugged)
+	config := testConfig(testIntf{"dataplane", "tst0s17", "applied"})
+	mgr.Apply(config)
+	testWaitState(t, mach, plugged)
+	want := findCommitRoot("tst0s17", config)
+	if running, _ := mgr.running("tst0s17"); !treesEqual(running, want) {
+		t.Fatal("Commit refused a session at the client session limit")
+	}
+
+	// take the id of the next commit's session
+	sid := sessionPrefix + "tst0s17_" +
+		strconv.FormatUint(atomic.LoadUint64(&sessionSeq)+1, 10)
+	if _, err := sessionmgr.New(sid, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer sessionmgr.Delete(sid)
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s17", "rejected"}))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if res := mach.lastResult(); res != nil && res.err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Commit without a session not reported as failed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if running, _ := mgr.running("tst0s17"); !treesEqual(running, want) {
+		t.Fatal("Running configuration advanced without a commit")
+	}
+	// retried once a session can be had
+	sessionmgr.Delete(sid)
+	testWaitState(t, mach, plugged)
+	want = findCommitRoot("tst0s17", testConfig(
+		testIntf{"dataplane", "tst0s17", "rejected"}))
+	if running, _ := mgr.running("tst0s17"); !treesEqual(running, want) {
+		t.Fatal("Commit not retried")
+	}
+}
+
+// A panic before the commit reaches the pool must not leave the
+// machine applying
+func TestCommitPanicLeavesApplying(t *testing.T) {
+	orig := commitIntf
+	commitIntf = func(string, *Committer) (bool, error) {
+		panic("commit exploded")
+	}
+	t.Cleanup(func() { commitIntf = orig })
+
+	mgr := NewIntfManager()
+	mgr.Register("tst0s18")
+	defer testUnregister(t, mgr, "tst0s18")
+	mgr.Apply(testConfig(testIntf{"dataplane", "tst0s18", "panics"}))
+	mgr.Plug("tst0s18")
+	mach := mgr.interfaces["tst0s18"]
+	testWaitState(t, mach, plugged)
+
+	state, _ := mgr.operationalState("tst0s18")
+	if !strings.Contains(state.LastError, "panicked") {
+		t.Fatalf("Last error %q, expected the panic", state.LastError)
+	}
+	if mach.running.Load() != mach.candidate.Load() {
+		t.Fatal("Panicked commit not treated as applied")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// metricSet holds the daemon's counters along with gauges that are
+// computed when the metrics are read.
+type metricSet struct {
+	sync.Mutex
+	counters map[string]int64
+	gauges   map[string]func() int64
+}
+
+var metrics = newMetricSet()
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]func() int64),
+	}
+}
+
+func (m *metricSet) Inc(name string) {
+	m.Add(name, 1)
+}
+
+func (m *metricSet) Add(name string, delta int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *metricSet) Gauge(name string, fn func() int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.gauges[name] = fn
+}
+
+func (m *metricSet) Snapshot() map[string]int64 {
+	m.Lock()
+	out := make(map[string]int64, len(m.counters)+len(m.gauges))
+	for name, v := range m.counters {
+		out[name] = v
+	}
+	gauges := make(map[string]func() int64, len(m.gauges))
+	for name, fn := range m.gauges {
+		gauges[name] = fn
+	}
+	m.Unlock()
+
+	// gauges may take other locks, don't hold ours while reading them
+	for name, fn := range gauges {
+		out[name] = fn()
+	}
+	return out
+}
+
+func (m *metricSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Snapshot())
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/danos/vci"
+)
+
+const (
+	notifyQueueLen = 1024
+	notifyAttempts = 3
+	notifyTimeout  = 5 * time.Second
+	notifyBackoff  = 100 * time.Millisecond
+)
+
+// errNotifyTimeout is returned when a notification has not been
+// emitted within notifyTimeout. Emitting can't be cancelled, so it
+// carries on in the background and may yet succeed.
+var errNotifyTimeout = errors.New("timed out")
+
+// emitNotification is replaced in tests to capture notifications
+var emitNotification = vci.EmitNotification
+
+type notification struct {
+	module string
+	name   string
+	object interface{}
+}
+
+// notifier emits notifications in the background, in the order they
+// were sent, so state transitions are never blocked waiting on
+// VCI. Notifications that cannot be emitted after a bounded number of
+// attempts, or that arrive while the queue is full, are dropped. One
+// that times out is not retried, as it may still be delivered.
+//
+// Emission may be rate limited. While limited, configuration-updated
+// and interface-state notifications can be combined into a single
+// batch-update notification rather than waiting their turn.
+type notifier struct {
+	queue chan *notification
+
+	mu      sync.Mutex
+	limiter *tokenBucket
+	batch   bool
+}
+
+var notifications = newNotifier()
+
+func newNotifier() *notifier {
+	n := &notifier{
+		queue: make(chan *notification, notifyQueueLen),
+	}
+	go n.run()
+	return n
+}
+
+func (n *notifier) Send(module, name string, object interface{}) {
+	select {
+	case n.queue <- &notification{module: module, name: name, object: object}:
+	default:
+		fmt.Fprintln(os.Stderr, "Notification queue full, dropping",
+			module+":"+name)
+		metrics.Inc("notifications-dropped")
+	}
+}
+
+// configure limits emission to rate notifications per second, allowing
+// bursts of up to burst. A rate of zero is unlimited.
+func (n *notifier) configure(rate float64, burst int, batch bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.limiter = nil
+	if rate > 0 {
+		n.limiter = newTokenBucket(rate, burst)
+	}
+	n.batch = batch
+}
+
+func (n *notifier) settings() (*tokenBucket, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.limiter, n.batch
+}
+
+func (n *notifier) run() {
+	var next *notification
+	for {
+		notif := next
+		next = nil
+		if notif == nil {
+			notif = <-n.queue
+		}
+		limiter, batch := n.settings()
+		if limiter != nil && !limiter.allow() {
+			if batch && batchEntryFor(notif) != nil {
+				notif, next = n.collect(notif, limiter)
+			} else {
+				limiter.wait()
+			}
+		}
+		n.emit(notif)
+	}
+}
+
+type BatchEntry struct {
+	Notification string `rfc7951:"notification" json:"notification"`
+	Interface    string `rfc7951:"interface" json:"interface"`
+	State        string `rfc7951:"state,omitempty" json:"state,omitempty"`
+}
+
+type BatchUpdate struct {
+	Update []*BatchEntry `rfc7951:"vyatta-ifmgr-v1:update" json:"update"`
+}
+
+// batchEntryFor returns the batch entry summarising the notification,
+// nil if it can't be batched.
+func batchEntryFor(notif *notification) *BatchEntry {
+	switch obj := notif.object.(type) {
+	case *ConfigurationUpdated:
+		return &BatchEntry{
+			Notification: notif.name,
+			Interface:    obj.Interface.Name,
+		}
+	case *InterfaceState:
+		return &BatchEntry{
+			Notification: notif.name,
+			Interface:    obj.Interface.Name,
+			State:        obj.Interface.State,
+		}
+	}
+	return nil
+}
+
+// collect gathers batchable notifications queued while waiting for the
+// limiter. It returns the notification to emit, a batch-update if more
+// than one was collected, and the notification that ended collection,
+// if any, to be emitted next.
+func (n *notifier) collect(
+	first *notification,
+	limiter *tokenBucket,
+) (*notification, *notification) {
+	entries := []*BatchEntry{batchEntryFor(first)}
+	batch := func() *notification {
+		if len(entries) == 1 {
+			return first
+		}
+		metrics.Add("notifications-batched", int64(len(entries)))
+		return &notification{
+			module: first.module,
+			name:   "batch-update",
+			object: &BatchUpdate{Update: entries},
+		}
+	}
+
+	timer := time.NewTimer(limiter.delay())
+	defer timer.Stop()
+	for {
+		select {
+		case notif := <-n.queue:
+			entry := batchEntryFor(notif)
+			if entry == nil {
+				limiter.wait()
+				return batch(), notif
+			}
+			entries = append(entries, entry)
+		case <-timer.C:
+			if limiter.allow() {
+				return batch(), nil
+			}
+			timer.Reset(limiter.delay())
+		}
+	}
+}
+
+func (n *notifier) emit(notif *notification) {
+	backoff := notifyBackoff
+	var err error
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		err = emitWithTimeout(notif)
+		if err == nil {
+			return
+		}
+		if err == errNotifyTimeout {
+			// retrying could deliver the notification twice
+			fmt.Fprintln(os.Stderr, "Timed out emitting",
+				notif.module+":"+notif.name, "after", notifyTimeout,
+				"- not retrying as it may yet be delivered")
+			metrics.Inc("notifications-timed-out")
+			return
+		}
+		if attempt < notifyAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Failed to emit", notif.module+":"+notif.name,
+		"after", notifyAttempts, "attempts:", err)
+	metrics.Inc("notifications-dropped")
+}
+
+// tokenBucket allows rate events per second on average, in bursts of
+// up to burst. It is only used by the notifier goroutine.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) allow() bool {
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// delay returns how long until an event will be allowed
+func (b *tokenBucket) delay() time.Duration {
+	b.refill()
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) wait() {
+	for !b.allow() {
+		time.Sleep(b.delay())
+	}
+}
+
+// emitWithTimeout emits notif, giving up waiting after notifyTimeout.
+// An emit that times out is left to finish in the background.
+func emitWithTimeout(notif *notification) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- emitNotification(notif.module, notif.name, notif.object)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(notifyTimeout):
+		return errNotifyTimeout
+	}
+}
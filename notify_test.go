@@ -0,0 +1,166 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/danos/encoding/rfc7951"
+)
+
+func testStateNotification(ifname, state string) *notification {
+	obj := &InterfaceState{}
+	obj.Interface.Name = ifname
+	obj.Interface.State = state
+	return &notification{
+		module: "vyatta-ifmgr-v1",
+		name:   "interface-state",
+		object: obj,
+	}
+}
+
+func TestTokenBucketLimitsBurst(t *testing.T) {
+	b := newTokenBucket(1, 2)
+	if !b.allow() || !b.allow() {
+		t.Fatal("Burst was not allowed")
+	}
+	if b.allow() {
+		t.Fatal("Allowed more than the burst")
+	}
+	if d := b.delay(); d <= 0 || d > time.Second {
+		t.Fatalf("Unexpected delay %s", d)
+	}
+}
+
+func TestCollectBatchesWaitingNotifications(t *testing.T) {
+	n := &notifier{queue: make(chan *notification, notifyQueueLen)}
+	limiter := newTokenBucket(20, 1)
+	limiter.allow()
+
+	first := testStateNotification("dp0s1", "plugged")
+	n.queue <- testStateNotification("dp0s2", "plugged")
+	n.queue <- testStateNotification("dp0s1", "applying")
+	stop := &notification{module: "vyatta-ifmgr-v1", name: "apply-timeout"}
+	n.queue <- stop
+
+	notif, next := n.collect(first, limiter)
+	if next != stop {
+		t.Fatalf("Collection ended with %v, expected %v", next, stop)
+	}
+	if notif.name != "batch-update" {
+		t.Fatalf("Emitted %s, expected batch-update", notif.name)
+	}
+	update := notif.object.(*BatchUpdate).Update
+	if len(update) != 3 {
+		t.Fatalf("Batched %d notifications, expected 3", len(update))
+	}
+	if e := update[2]; e.Interface != "dp0s1" || e.State != "applying" {
+		t.Fatalf("Unexpected final entry %+v", e)
+	}
+}
+
+func TestCollectSingleNotificationIsUnbatched(t *testing.T) {
+	n := &notifier{queue: make(chan *notification, notifyQueueLen)}
+	limiter := newTokenBucket(50, 1)
+	limiter.allow()
+
+	first := testStateNotification("dp0s1", "plugged")
+	notif, next := n.collect(first, limiter)
+	if notif != first || next != nil {
+		t.Fatalf("Expected %v alone, got %v then %v", first, notif, next)
+	}
+}
+
+// Check that a notification marshals as RFC7951 to the JSON expected
+// by the vyatta-ifmgr-v1 schema
+func checkNotificationShape(t *testing.T, object interface{}, expect string) {
+	t.Helper()
+	out, err := rfc7951.Marshal(object)
+	if err != nil {
+		t.Fatalf("Failed to marshal %T: %s", object, err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("%T marshaled to invalid JSON %s: %s", object, out, err)
+	}
+	json.Unmarshal([]byte(expect), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%T marshaled as\n  %s\nexpected\n  %s", object, out, expect)
+	}
+}
+
+func TestConfigurationUpdatedShape(t *testing.T) {
+	var cu ConfigurationUpdated
+	cu.Interface.Name = "dp0s1"
+	checkNotificationShape(t, &cu,
+		`{"vyatta-ifmgr-v1:interface":{"name":"dp0s1"}}`)
+
+	cu.Transaction = "txn1"
+	checkNotificationShape(t, &cu,
+		`{"vyatta-ifmgr-v1:interface":{"name":"dp0s1"},
+		  "vyatta-ifmgr-v1:transaction":"txn1"}`)
+}
+
+func TestInterfaceConfigRemovedShape(t *testing.T) {
+	var r InterfaceConfigRemoved
+	r.Interface.Name = "dp0s1"
+	checkNotificationShape(t, &r,
+		`{"vyatta-ifmgr-v1:interface":{"name":"dp0s1"}}`)
+
+	r.Transaction = "txn1"
+	checkNotificationShape(t, &r,
+		`{"vyatta-ifmgr-v1:interface":{"name":"dp0s1"},
+		  "vyatta-ifmgr-v1:transaction":"txn1"}`)
+}
+
+func TestInterfaceStateShape(t *testing.T) {
+	var s InterfaceState
+	s.Interface.Name = "dp0s1"
+	s.Interface.State = "plugged"
+	checkNotificationShape(t, &s,
+		`{"vyatta-ifmgr-v1:interface":{"name":"dp0s1","state":"plugged"}}`)
+
+	s.Interface.Reason = "udev"
+	checkNotificationShape(t, &s,
+		`{"vyatta-ifmgr-v1:interface":
+		  {"name":"dp0s1","state":"plugged","reason":"udev"}}`)
+}
+
+func TestApplyTimeoutShape(t *testing.T) {
+	var a ApplyTimeout
+	a.Interface.Name = "dp0s1"
+	a.Interface.State = "applying"
+	checkNotificationShape(t, &a,
+		`{"vyatta-ifmgr-v1:interface":{"name":"dp0s1","state":"applying"}}`)
+}
+
+func TestInterfaceOnlyNotificationShapes(t *testing.T) {
+	var u InterfaceUnmanaged
+	u.Interface.Name = "dp0s1"
+	checkNotificationShape(t, &u,
+		`{"vyatta-ifmgr-v1:interface":{"name":"dp0s1"}}`)
+
+	var w WaitingForHardware
+	w.Interface.Name = "dp0s1"
+	checkNotificationShape(t, &w,
+		`{"vyatta-ifmgr-v1:interface":{"name":"dp0s1"}}`)
+}
+
+func TestBatchUpdateShape(t *testing.T) {
+	b := &BatchUpdate{Update: []*BatchEntry{
+		{Notification: "configuration-updated", Interface: "dp0s1"},
+		{Notification: "interface-state", Interface: "dp0s2",
+			State: "unplugged"},
+	}}
+	checkNotificationShape(t, b,
+		`{"vyatta-ifmgr-v1:update":[
+		  {"notification":"configuration-updated","interface":"dp0s1"},
+		  {"notification":"interface-state","interface":"dp0s2",
+		   "state":"unplugged"}]}`)
+}
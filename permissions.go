@@ -0,0 +1,127 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Permission is a set of the operations a caller may perform.
+type Permission uint
+
+const (
+	// Read configuration, state and statistics
+	PermRead Permission = 1 << iota
+	// Apply, reset and reconcile configuration and send plug events
+	PermApply
+	// Start and stop managing interfaces
+	PermRegister
+	// Reach beyond interface configuration: commit output, files on
+	// the daemon's system and configd RPCs
+	PermAdmin
+	// See secrets in configuration rather than having them redacted
+	PermSecrets
+
+	PermAll = PermRead | PermApply | PermRegister | PermAdmin
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermRead, "read"},
+	{PermApply, "apply"},
+	{PermRegister, "register"},
+	{PermAdmin, "admin"},
+	{PermSecrets, "secrets"},
+}
+
+func (p Permission) String() string {
+	var names []string
+	for _, pn := range permissionNames {
+		if p&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	if names == nil {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// PermissionMapper maps a caller's credentials to the operations it
+// may perform. It is consulted once per connection.
+type PermissionMapper interface {
+	// Permissions returns the operations permitted to the caller with
+	// cred, a member of the named groups. cred is nil, and groups
+	// empty, if the caller's credentials could not be read.
+	Permissions(cred *syscall.Ucred, groups []string) Permission
+}
+
+// defaultPermissions lets every caller do everything, showing secrets
+// to members of the secrets group.
+type defaultPermissions struct{}
+
+func (defaultPermissions) Permissions(
+	_ *syscall.Ucred,
+	groups []string,
+) Permission {
+	for _, gr := range groups {
+		if gr == "secrets" {
+			return PermAll | PermSecrets
+		}
+	}
+	return PermAll
+}
+
+// methodPermissions gives the permission needed to call each method
+// that does more than read; every other method needs PermRead. It is
+// the one record of what each method may do: the methods left out are
+// those callers outside the trusted groups may use.
+var methodPermissions = map[string]Permission{
+	"Apply":             PermApply,
+	"ApplyWithTxn":      PermApply,
+	"ApplyInterface":    PermApply,
+	"ApplyCAS":          PermApply,
+	"SyncFromConfigd":   PermApply,
+	"ResetInterface":    PermApply,
+	"Plug":              PermApply,
+	"Unplug":            PermApply,
+	"PlugWithReason":    PermApply,
+	"UnplugWithReason":  PermApply,
+	"Reconcile":         PermApply,
+	"ClearError":        PermApply,
+	"Register":          PermRegister,
+	"Unregister":        PermRegister,
+	"Decommission":      PermRegister,
+	"LastOutput":        PermAdmin,
+	"DumpConfig":        PermAdmin,
+	"ReadConfigFile":    PermAdmin,
+	"MigrateConfigFile": PermAdmin,
+	"CallRpc":           PermAdmin,
+	"CallRpcXml":        PermAdmin,
+	"ConfigdTreeGet":    PermAdmin,
+}
+
+// requiredPermission returns the permission needed to call method.
+func requiredPermission(method string) Permission {
+	if perm, ok := methodPermissions[method]; ok {
+		return perm
+	}
+	return PermRead
+}
+
+// readMethods lists the RPC methods that need no more than PermRead.
+func readMethods() []string {
+	var out []string
+	for _, name := range rpcMethods {
+		if requiredPermission(name) == PermRead {
+			out = append(out, name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/danos/config/union"
+)
+
+func TestMethodPermissionsRegistered(t *testing.T) {
+	reg, _ := newMethodRegistry(rpcMethods...)
+	for name := range methodPermissions {
+		if _, ok := reg[name]; !ok {
+			t.Errorf("Method %s given a permission is not a registered RPC",
+				name)
+		}
+	}
+}
+
+// By default everyone may do everything, as before permissions were
+// mapped, and only members of the secrets group see secrets.
+func TestDefaultPermissions(t *testing.T) {
+	var mapper defaultPermissions
+	if perms := mapper.Permissions(nil, nil); perms != PermAll {
+		t.Fatalf("Unknown caller given %s", perms)
+	}
+	perms := mapper.Permissions(nil, []string{"users", "secrets"})
+	if perms != PermAll|PermSecrets {
+		t.Fatalf("Member of secrets given %s", perms)
+	}
+}
+
+func TestCallRequiresPermission(t *testing.T) {
+	reg, _ := newMethodRegistry(rpcMethods...)
+	conn := &SrvConn{
+		srv:   &Srv{m: reg},
+		perms: PermRead | PermApply,
+	}
+	_, err := conn.Call(nil, "Register", []interface{}{"dp0s3"})
+	if err == nil || !strings.Contains(err.Error(), "register permission") {
+		t.Fatalf("Register without permission gave error %v", err)
+	}
+}
+
+// Untrusted callers are limited to reading, so may use exactly the
+// methods needing no more than PermRead
+func TestUntrustedMethodsOnlyRead(t *testing.T) {
+	for _, name := range DefaultUntrustedMethods {
+		if need := requiredPermission(name); need != PermRead {
+			t.Errorf("Untrusted method %s needs %s", name, need)
+		}
+	}
+	for _, name := range []string{"Apply", "Register", "ConfigdTreeGet"} {
+		for _, untrusted := range DefaultUntrustedMethods {
+			if name == untrusted {
+				t.Errorf("%s available to untrusted callers", name)
+			}
+		}
+	}
+}
+
+// Asking for secrets only shows them to callers allowed to see them
+func TestTreeOptionsHideSecretsWithoutPermission(t *testing.T) {
+	hides := func(opts []union.UnionOption) bool {
+		hide := reflect.ValueOf(union.HideSecrets).Pointer()
+		for _, opt := range opts {
+			if reflect.ValueOf(opt).Pointer() == hide {
+				return true
+			}
+		}
+		return false
+	}
+	asked := map[string]interface{}{"Secrets": true}
+	if !hides(treeOptions(asked, false)) {
+		t.Fatal("Secrets shown to a caller without permission")
+	}
+	if hides(treeOptions(asked, true)) {
+		t.Fatal("Secrets hidden from a caller with permission")
+	}
+	if !hides(treeOptions(nil, true)) {
+		t.Fatal("Secrets shown without being asked for")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"github.com/danos/config/data"
+	"github.com/danos/config/schema"
+	"github.com/danos/utils/pathutil"
+)
+
+const redactedValue = "********"
+
+// redactor hides configuration values that must never be logged or
+// reported to subscribers, whoever is asking: those of secret nodes
+// and of nodes matching one of the configured paths. Path elements
+// may be "*" to match any single element, such as a list key.
+type redactor struct {
+	paths [][]string
+}
+
+func newRedactor(paths []string) *redactor {
+	r := &redactor{}
+	for _, p := range paths {
+		r.paths = append(r.paths, pathutil.Makepath(p))
+	}
+	return r
+}
+
+// matches reports whether the node at path is always redacted
+func (r *redactor) matches(path []string) bool {
+	for _, p := range r.paths {
+		if len(p) != len(path) {
+			continue
+		}
+		matched := true
+		for i, elem := range p {
+			if elem != "*" && elem != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redactor) hides(sn schema.Node, path []string) bool {
+	if sn != nil {
+		if ext := sn.ConfigdExt(); ext != nil && ext.Secret {
+			return true
+		}
+	}
+	return r.matches(path)
+}
+
+// tree returns a copy of the tree with the values of redacted nodes
+// replaced, for logging.
+func (r *redactor) tree(n *data.Node, sn schema.Node) *data.Node {
+	if n == nil {
+		return nil
+	}
+	return r.copy(n, sn, nil)
+}
+
+func (r *redactor) copy(n *data.Node, sn schema.Node, path []string) *data.Node {
+	out := data.New(n.Name())
+	for _, ch := range n.Children() {
+		chpath := append(path[:len(path):len(path)], ch.Name())
+		var chsn schema.Node
+		if sn != nil {
+			chsn = sn.SchemaChild(ch.Name())
+		}
+		if r.hides(chsn, chpath) && ch.NumChildren() != 0 {
+			hidden := data.New(ch.Name())
+			hidden.AddChild(data.New(redactedValue))
+			out.AddChild(hidden)
+			continue
+		}
+		out.AddChild(r.copy(ch, chsn, chpath))
+	}
+	return out
+}
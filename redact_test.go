@@ -0,0 +1,31 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import "testing"
+
+func TestRedactorHidesMatchingValues(t *testing.T) {
+	config := testConfig(
+		testIntf{"dataplane", "tst0s1", "hidden"},
+		testIntf{"loopback", "lo", "shown"})
+	r := newRedactor([]string{"/interfaces/dataplane/*/description"})
+
+	out := r.tree(config, nil)
+	desc := out.Descendant(
+		[]string{"interfaces", "dataplane", "tst0s1", "description"})
+	if names := desc.ChildNames(); len(names) != 1 ||
+		names[0] != redactedValue {
+		t.Fatalf("Description %v not redacted", names)
+	}
+	if out.Descendant([]string{"interfaces", "loopback", "lo",
+		"description", "shown"}) == nil {
+		t.Fatal("Unmatched description was redacted")
+	}
+	if config.Descendant([]string{"interfaces", "dataplane", "tst0s1",
+		"description", "hidden"}) == nil {
+		t.Fatal("Redaction modified the original tree")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// rpcMethods is the RPC surface of the server. Only the Disp methods
+// named here may be called by clients; adding a method to Disp does
+// not expose it until it is listed.
+var rpcMethods = []string{
+	//ifmgrd specific
+	"Apply",
+	"ApplyWithTxn",
+	"ApplyInterface",
+	"ApplyCAS",
+	"ApplyGeneration",
+	"SyncFromConfigd",
+	"Register",
+	"Unregister",
+	"Decommission",
+	"ResetInterface",
+	"Plug",
+	"Unplug",
+	"PlugWithReason",
+	"UnplugWithReason",
+	"Reconcile",
+	"ClearError",
+	"LastOutput",
+	"Running",
+	"RunningEffective",
+	"RunningExists",
+	"DumpConfig",
+	"ManagerConfig",
+	"ListManaged",
+	"TypeSummary",
+	"MaxApplyLag",
+	"Stats",
+	"Metrics",
+	"ListCommits",
+	"Transitions",
+	"StateGraph",
+	"OperationalState",
+	"QueueDepths",
+	"AllConverged",
+	"PendingInterfaces",
+	"Applying",
+	"TimeInState",
+	"LatencyStats",
+	"InterfaceCounters",
+	"InterfaceState",
+	"InterfaceStates",
+	"CommitActions",
+	"DiffJSON",
+	"CandidateRunning",
+	"DaemonConfig",
+
+	//configd session emulation
+	"Get",
+	"Exists",
+	"NodeGetStatus",
+	"NodeIsDefault",
+	"TreeGet",
+	"SessionExists",
+	"ListSessions",
+
+	//proxied to configd
+	"ConfigdTreeGet",
+	"NodeGetType",
+	"TmplGet",
+	"TmplGetChildren",
+	"TmplValidatePath",
+	"TmplValidateValues",
+	"SchemaGet",
+	"GetSchemas",
+	"AuthAuthorize",
+	"ReadConfigFile",
+	"CallRpc",
+	"CallRpcXml",
+	"MigrateConfigFile",
+	"Expand",
+}
+
+type methodRegistry map[string]reflect.Method
+
+// newMethodRegistry looks up each named method on *Disp and checks
+// it has a signature that can be called as an RPC.
+func newMethodRegistry(names ...string) (methodRegistry, error) {
+	reg := make(methodRegistry)
+	t := reflect.TypeOf(new(Disp))
+	for _, name := range names {
+		meth, ok := t.MethodByName(name)
+		if !ok {
+			return nil, fmt.Errorf("RPC method %s is not defined", name)
+		}
+		ftype := meth.Func.Type()
+		if ftype.NumOut() != 2 {
+			return nil, fmt.Errorf(
+				"RPC method %s must return 2 values", name)
+		}
+		if ftype.Out(1).Name() != "error" {
+			return nil, fmt.Errorf(
+				"RPC method %s must return an error as second value",
+				name)
+		}
+		reg[name] = meth
+	}
+	return reg, nil
+}
@@ -12,68 +12,112 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unicode"
 )
 
 type Srv struct {
+	// current wait after temporary accept errors in nanoseconds, zero
+	// when accepting. Accessed atomically so is kept first for
+	// alignment.
+	acceptBackoff int64
 	*net.UnixListener
-	m      map[string]reflect.Method
-	Config *Config
+	shutdown      int32
+	m             methodRegistry
+	Config        *Config
+	trustedGroups map[string]struct{}
 }
 
 func NewSrv(l *net.UnixListener, config *Config) *Srv {
 	s := &Srv{
-		UnixListener: l,
-		m:            make(map[string]reflect.Method),
-		Config:       config,
+		UnixListener:  l,
+		Config:        config,
+		trustedGroups: make(map[string]struct{}),
+	}
+	intfmgr.configure(config)
+	commitWorkers.setHooks(config.CommitHooks)
+	sessionmgr.setMax(config.MaxSessions)
+	notifications.configure(
+		config.NotifyRate, config.NotifyBurst, config.NotifyBatch)
+	metrics.Gauge("accept-backoff-ms", func() int64 {
+		return atomic.LoadInt64(&s.acceptBackoff) / int64(time.Millisecond)
+	})
+	if config.PlugPollInterval > 0 {
+		intfmgr.PollPlugged(config.PlugPollInterval)
+	}
+	if err := intfmgr.LoadRegistrations(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to restore registered interfaces:",
+			err)
 	}
 
-	t := reflect.TypeOf(new(Disp))
-	for m := 0; m < t.NumMethod(); m++ {
-		meth := t.Method(m)
-		ftype := meth.Func.Type()
-		if unicode.IsLower(rune(meth.Name[0])) {
-			//only exported methods
-			continue
-		}
-		if ftype.NumOut() != 2 {
-			//with 2 return values
-			continue
-		}
-		if ftype.Out(1).Name() != "error" {
-			//whose second return value is an error
-			continue
-		}
+	m, err := newMethodRegistry(rpcMethods...)
+	s.LogFatal(err)
+	s.m = m
 
-		s.m[meth.Name] = meth
+	for _, gr := range config.TrustedGroups {
+		s.trustedGroups[gr] = struct{}{}
 	}
+
 	return s
 }
 
 //Serve is the server main loop.
 //It accepts connections and spawns a goroutine to handle that connection.
+//It returns nil once Shutdown is called, or the error that stopped it.
 func (s *Srv) Serve() error {
-	var err error
 	for {
 		conn, err := s.AcceptUnix()
 		if err != nil {
+			if atomic.LoadInt32(&s.shutdown) != 0 {
+				return nil
+			}
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				time.Sleep(10 * time.Millisecond)
+				metrics.Inc("accept-errors")
+				time.Sleep(s.nextAcceptBackoff())
 				continue
 			}
 			s.LogError(err)
-			break
+			return err
 		}
+		atomic.StoreInt64(&s.acceptBackoff, 0)
 		sconn := s.NewConn(conn)
 
 		go sconn.Handle()
 	}
+}
+
+// nextAcceptBackoff returns how long to wait after a temporary accept
+// error, such as running out of file descriptors. The wait doubles
+// with each consecutive error up to the configured maximum.
+func (s *Srv) nextAcceptBackoff() time.Duration {
+	base, max := s.Config.acceptBackoffs()
+	backoff := 2 * time.Duration(atomic.LoadInt64(&s.acceptBackoff))
+	if backoff < base {
+		backoff = base
+	}
+	if backoff > max {
+		backoff = max
+	}
+	atomic.StoreInt64(&s.acceptBackoff, int64(backoff))
+	return backoff
+}
+
+// Shutdown stops the server accepting connections, so Serve returns,
+// and waits for commits already started to complete. Later commits
+// fail rather than run.
+func (s *Srv) Shutdown() error {
+	atomic.StoreInt32(&s.shutdown, 1)
+	err := s.UnixListener.Close()
+	commitWorkers.Shutdown()
 	return err
 }
 
+func (s *Srv) isTrustedGroup(name string) bool {
+	_, ok := s.trustedGroups[name]
+	return ok
+}
+
 //NewConn creates a new SrvConn and returns a reference to it.
 func (s *Srv) NewConn(conn *net.UnixConn) *SrvConn {
 	enc := json.NewEncoder(conn)
@@ -0,0 +1,126 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRpcMethodsRegister(t *testing.T) {
+	if _, err := newMethodRegistry(rpcMethods...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryRejectsHelpers(t *testing.T) {
+	if _, err := newMethodRegistry("validatePath"); err == nil {
+		t.Fatal("Unexported helper registered as RPC method")
+	}
+}
+
+func TestUntrustedMethodsRegistered(t *testing.T) {
+	reg, _ := newMethodRegistry(rpcMethods...)
+	for _, name := range DefaultUntrustedMethods {
+		if _, ok := reg[name]; !ok {
+			t.Errorf("Untrusted method %s is not a registered RPC", name)
+		}
+	}
+}
+
+// A configuration sent to Apply as a JSON object rather than a string
+// holding one is accepted, while other arguments must have their type.
+func TestApplyAcceptsConfigObject(t *testing.T) {
+	reg, _ := newMethodRegistry(rpcMethods...)
+	var args []interface{}
+	json.Unmarshal([]byte(`[{"interfaces":{}}]`), &args)
+	vals, err := callArgs(nil, "Apply", reg["Apply"].Func.Type(), args)
+	if err != nil {
+		t.Fatalf("Object rejected: %s", err)
+	}
+	if cfg := vals[1].String(); cfg != `{"interfaces":{}}` {
+		t.Fatalf("Object passed to Apply as %q", cfg)
+	}
+
+	json.Unmarshal([]byte(`[["interfaces"]]`), &args)
+	_, err = callArgs(nil, "Apply", reg["Apply"].Func.Type(), args)
+	if err == nil || !strings.Contains(err.Error(), "got array") {
+		t.Fatalf("Array passed to Apply gave error %v", err)
+	}
+
+	json.Unmarshal([]byte(`[null]`), &args)
+	_, err = callArgs(nil, "Register", reg["Register"].Func.Type(), args)
+	if _, ok := err.(*ArgErr); !ok {
+		t.Fatalf("Null passed to Register gave error %v", err)
+	}
+}
+
+// A client may send several requests before reading any response; each
+// is answered once, matched by Id, whatever order they complete in.
+func TestConnPipelinedRequests(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "pipeline.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	reg, _ := newMethodRegistry(rpcMethods...)
+	srv := &Srv{
+		UnixListener: l,
+		m:            reg,
+		Config:       &Config{ConnConcurrency: 4, AlwaysShowSecrets: true},
+	}
+	go func() {
+		conn, err := l.AcceptUnix()
+		if err == nil {
+			srv.NewConn(conn).Handle()
+		}
+	}()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	const n = 16
+	enc := json.NewEncoder(conn)
+	for id := 1; id <= n; id++ {
+		if err := enc.Encode(&Request{Method: "ListManaged", Id: id}); err != nil {
+			t.Fatalf("Failed to send request %d: %s", id, err)
+		}
+	}
+	dec := json.NewDecoder(conn)
+	seen := make(map[int]bool)
+	for i := 0; i < n; i++ {
+		var resp Response
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("Failed to read response %d: %s", i, err)
+		}
+		if seen[resp.Id] || resp.Id < 1 || resp.Id > n {
+			t.Fatalf("Unexpected response id %d", resp.Id)
+		}
+		seen[resp.Id] = true
+	}
+}
+
+// Consecutive accept errors double the wait up to the maximum
+func TestAcceptBackoffDoublesToMax(t *testing.T) {
+	s := &Srv{Config: &Config{
+		AcceptBackoff:    10 * time.Millisecond,
+		AcceptBackoffMax: 35 * time.Millisecond,
+	}}
+	want := []time.Duration{10, 20, 35, 35}
+	for i, w := range want {
+		if got := s.nextAcceptBackoff(); got != w*time.Millisecond {
+			t.Fatalf("Wait %d was %s, expected %s",
+				i, got, w*time.Millisecond)
+		}
+	}
+}
@@ -7,7 +7,9 @@
 package ifmgrd
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/danos/config/data"
 	"github.com/danos/config/schema"
@@ -18,11 +20,14 @@ type Session struct {
 	candidate *data.Node
 	running   *data.Node
 	schema    schema.Node
+	created   time.Time
 }
 
 type Sessions struct {
 	sync.RWMutex
 	sessions map[string]*Session
+	// maximum number of sessions, zero for unlimited
+	max int
 }
 
 func NewSessionMap() *Sessions {
@@ -44,15 +49,82 @@ func (s *Sessions) New(
 		err.Message = "session exists"
 		return nil, err
 	}
+	// ifmgrd's own commits must not be refused for want of a session
+	if s.max > 0 && interfaceFromSid(sid) == "" &&
+		s.clientSessions() >= s.max {
+		metrics.Inc("sessions-rejected")
+		err := mgmterror.NewOperationFailedApplicationError()
+		err.Message = fmt.Sprintf(
+			"Cannot create session: limit of %d sessions reached", s.max)
+		return nil, err
+	}
 	sess = &Session{
 		candidate: candidate,
 		running:   running,
 		schema:    schema,
+		created:   time.Now(),
 	}
 	s.sessions[sid] = sess
 	return sess, nil
 }
 
+// clientSessions counts the sessions opened by clients rather than
+// for ifmgrd's commits.
+//
+// clientSessions must be called with the sessions locked
+func (s *Sessions) clientSessions() int {
+	n := 0
+	for sid := range s.sessions {
+		if interfaceFromSid(sid) == "" {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Sessions) setMax(max int) {
+	s.Lock()
+	defer s.Unlock()
+	s.max = max
+}
+
+func (s *Sessions) stats(out *Stats) {
+	s.RLock()
+	defer s.RUnlock()
+	out.Sessions = len(s.sessions)
+	out.MaxSessions = s.max
+}
+
+// registerMetrics exports the number of sessions and the age of the
+// oldest, which grows without bound if sessions are leaked.
+func (s *Sessions) registerMetrics() {
+	metrics.Gauge("sessions", func() int64 {
+		s.RLock()
+		defer s.RUnlock()
+		return int64(len(s.sessions))
+	})
+	metrics.Gauge("session-oldest-age-ms", func() int64 {
+		return int64(s.oldestAge() / time.Millisecond)
+	})
+}
+
+// oldestAge returns how long the oldest session has existed, zero if
+// there are none.
+func (s *Sessions) oldestAge() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	var oldest time.Time
+	for _, sess := range s.sessions {
+		if oldest.IsZero() || sess.created.Before(oldest) {
+			oldest = sess.created
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
 func (s *Sessions) Delete(sid string) {
 	s.Lock()
 	defer s.Unlock()
@@ -63,6 +135,30 @@ func (s *Sessions) Delete(sid string) {
 	delete(s.sessions, sid)
 }
 
+// DeleteInterface removes all sessions created for the interface's
+// commits.
+func (s *Sessions) DeleteInterface(ifname string) {
+	s.Lock()
+	defer s.Unlock()
+	for sid := range s.sessions {
+		if interfaceFromSid(sid) == ifname {
+			delete(s.sessions, sid)
+		}
+	}
+}
+
+// interfaces returns the interface each session was created for, ""
+// for a session not created for a commit.
+func (s *Sessions) interfaces() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	out := make(map[string]string, len(s.sessions))
+	for sid := range s.sessions {
+		out[sid] = interfaceFromSid(sid)
+	}
+	return out
+}
+
 func (s *Sessions) Get(sid string) *Session {
 	s.RLock()
 	defer s.RUnlock()
@@ -0,0 +1,87 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionsRejectedBeyondMax(t *testing.T) {
+	sessions := NewSessionMap()
+	sessions.setMax(2)
+	for _, sid := range []string{"s1", "s2"} {
+		if _, err := sessions.New(sid, nil, nil, nil); err != nil {
+			t.Fatalf("Session %s rejected: %s", sid, err)
+		}
+	}
+	if _, err := sessions.New("s3", nil, nil, nil); err == nil {
+		t.Fatal("Session beyond the limit was created")
+	}
+
+	var stats Stats
+	sessions.stats(&stats)
+	if stats.Sessions != 2 || stats.MaxSessions != 2 {
+		t.Fatalf("Unexpected session stats %+v", stats)
+	}
+	sessions.Delete("s1")
+	if _, err := sessions.New("s3", nil, nil, nil); err != nil {
+		t.Fatalf("Session rejected after one was deleted: %s", err)
+	}
+}
+
+func TestSessionsOldestAge(t *testing.T) {
+	sessions := NewSessionMap()
+	if age := sessions.oldestAge(); age != 0 {
+		t.Fatalf("Oldest age %s with no sessions", age)
+	}
+	sessions.New("old", nil, nil, nil)
+	sessions.sessions["old"].created = time.Now().Add(-time.Hour)
+	sessions.New("new", nil, nil, nil)
+	if age := sessions.oldestAge(); age < time.Hour {
+		t.Fatalf("Oldest age %s, expected at least an hour", age)
+	}
+	sessions.Delete("old")
+	if age := sessions.oldestAge(); age >= time.Hour {
+		t.Fatalf("Oldest age %s after the oldest was deleted", age)
+	}
+}
+
+func TestInterfaceFromSid(t *testing.T) {
+	for sid, intf := range map[string]string{
+		newSessionId("dp0s3"):    "dp0s3",
+		newSessionId("dp0s3.10"): "dp0s3.10",
+		newSessionId("tun_a_b"):  "tun_a_b",
+		"INTF_dp0s3_":            "",
+		"INTF__1":                "",
+		"INTF_dp0s3_2021-08-02":  "",
+		"RUNNING":                "",
+	} {
+		if got := interfaceFromSid(sid); got != intf {
+			t.Errorf("Session %s gave interface %q, expected %q",
+				sid, got, intf)
+		}
+	}
+	if newSessionId("dp0s3") == newSessionId("dp0s3") {
+		t.Fatal("Session ids repeated")
+	}
+}
+
+func TestSessionsDeleteInterface(t *testing.T) {
+	sessions := NewSessionMap()
+	for _, intf := range []string{"dp0s3", "dp0s3_1", "dp0s3"} {
+		sessions.New(newSessionId(intf), nil, nil, nil)
+	}
+	sessions.New("RUNNING", nil, nil, nil)
+	sessions.DeleteInterface("dp0s3")
+	left := make(map[string]int)
+	for _, intf := range sessions.interfaces() {
+		left[intf]++
+	}
+	if len(left) != 2 || left["dp0s3_1"] != 1 || left[""] != 1 {
+		t.Fatalf("Sessions left for interfaces %v", left)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stateGraph renders the transition table as a Graphviz DOT digraph,
+// with an edge labelled by the event for each state a transition may
+// lead to.
+func stateGraph() string {
+	table := newTransitionTable()
+	states := make([]State, 0, len(table))
+	for state := range table {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+
+	var b strings.Builder
+	b.WriteString("digraph ifmgrd {\n")
+	for _, state := range states {
+		typs := make([]messageType, 0, len(table[state]))
+		for typ := range table[state] {
+			typs = append(typs, typ)
+		}
+		sort.Slice(typs, func(i, j int) bool { return typs[i] < typs[j] })
+		for _, typ := range typs {
+			for _, to := range table[state][typ].targets {
+				fmt.Fprintf(&b, "\t%q -> %q [label=%q];\n",
+					state.String(), to.String(), typ.String())
+			}
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2021, AT&T Intellectual Property.
+// All rights reserved.
+//
+// SPDX-License-Identifier: GPL-2.0-only
+
+package ifmgrd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Fail the run if any test drove a machine through a transition its
+// table entry does not list, leaving the state graph wrong.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if n := metrics.Snapshot()["transitions-unlisted"]; n != 0 && code == 0 {
+		fmt.Fprintln(os.Stderr, n, "transitions not listed in the "+
+			"transition table")
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// Every transition must list the states it may lead to
+func TestTransitionsListTargets(t *testing.T) {
+	for state, handlers := range newTransitionTable() {
+		for typ, trans := range handlers {
+			if len(trans.targets) == 0 {
+				t.Errorf("No targets for %s in %s", typ, state)
+			}
+		}
+	}
+}
+
+func TestStateGraph(t *testing.T) {
+	out := stateGraph()
+	if !strings.HasPrefix(out, "digraph ifmgrd {\n") {
+		t.Fatalf("Not a DOT digraph:\n%s", out)
+	}
+	edge := `"Unplugged" -> "Applying" [label="Plug"];`
+	if !strings.Contains(out, edge) {
+		t.Fatalf("Missing edge %s:\n%s", edge, out)
+	}
+}